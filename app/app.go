@@ -0,0 +1,234 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type ApplicationOptions struct {
+	LoadConfigOptions
+
+	// RefreshPeriod overrides the config refresh period when set.
+	RefreshPeriod time.Duration
+
+	// AdminToken guards the admin endpoints, they are disabled when empty.
+	AdminToken string
+
+	// WaitFirstScrape makes /healthz unavailable until the first push
+	// cycle completes.
+	WaitFirstScrape bool
+
+	// SeparateMetrics leaves the metrics out of the application handler, to
+	// be served with NewMetricsHandlerAt(app.Gatherer(), path) instead.
+	SeparateMetrics bool
+
+	// MetricsAddr is the address the separate metrics are served at, the
+	// dashboard polls them there.
+	MetricsAddr string
+}
+
+// Application runs the watch and HTTP services of a config file and
+// rebuilds them when the config is reloaded.
+type Application struct {
+	configFile string
+	opts       ApplicationOptions
+
+	mu     sync.RWMutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	config AppConfig
+	ws     *WatchService
+	hs     *HTTPService
+
+	// ready is closed when the first watch service is ready
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+func NewApplication(configFile string, opts ApplicationOptions) *Application {
+	return &Application{
+		configFile: configFile,
+		opts:       opts,
+		ready:      make(chan struct{}),
+	}
+}
+
+// Start loads the config file and starts watching until ctx is done.
+func (a *Application) Start(ctx context.Context) error {
+	a.mu.Lock()
+	a.ctx = ctx
+	a.mu.Unlock()
+	return a.Reload()
+}
+
+// Reload loads the config file and swaps in services built from it. The
+// previous services are kept running if the config is invalid.
+func (a *Application) Reload() error {
+	config, err := LoadConfigWithOptions(a.configFile, a.opts.LoadConfigOptions)
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		return err
+	}
+
+	ws := NewWatchService(config)
+	var hs *HTTPService
+	if a.opts.SeparateMetrics {
+		hs = NewHTTPService(config, nil)
+		hs.SetMetricsAddr(a.opts.MetricsAddr)
+	} else {
+		hs = NewHTTPService(config, ws.Gatherer())
+	}
+	hs.HandleSources(ws.SourcesStatus)
+	hs.HandleLive(ws.Subscribe)
+	if err := hs.HandleConfigYAML(config, a.authorize); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cancel != nil {
+		a.cancel()
+	}
+	ctx, cancel := context.WithCancel(a.ctx)
+	a.config, a.ws, a.hs, a.cancel = config, ws, hs, cancel
+	go ws.Start(ctx, a.refreshPeriod(config))
+	go func() {
+		select {
+		case <-ws.Ready():
+			a.readyOnce.Do(func() { close(a.ready) })
+		case <-ctx.Done():
+		}
+	}()
+
+	appLog("Application").WithField("configFile", a.configFile).Info("Config loaded")
+	return nil
+}
+
+// refreshPeriod returns the refresh period of the option, the config or
+// DefaultRefreshPeriod, in that order.
+func (a *Application) refreshPeriod(config AppConfig) time.Duration {
+	switch {
+	case a.opts.RefreshPeriod != 0:
+		return a.opts.RefreshPeriod
+	case config.RefreshPeriod != 0:
+		return config.RefreshPeriod
+	default:
+		return DefaultRefreshPeriod
+	}
+}
+
+// Config returns the config in effect.
+func (a *Application) Config() AppConfig {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.config
+}
+
+// Gatherer returns a gatherer following the current watch service.
+func (a *Application) Gatherer() prom.Gatherer {
+	return prom.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		a.mu.RLock()
+		ws := a.ws
+		a.mu.RUnlock()
+		return ws.Gatherer().Gather()
+	})
+}
+
+// Ready returns a channel closed when the first push cycle completes.
+func (a *Application) Ready() <-chan struct{} {
+	return a.ready
+}
+
+func (a *Application) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/reload":
+		a.authorize(a.serveReload)(w, r)
+		return
+	case "/healthz":
+		a.serveHealthz(w, r)
+		return
+	}
+	a.mu.RLock()
+	hs := a.hs
+	a.mu.RUnlock()
+	hs.ServeHTTP(w, r)
+}
+
+// authorize guards an admin handler with the bearer admin token.
+func (a *Application) authorize(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.opts.AdminToken == "" {
+			httpError(w, r, "admin endpoints disabled", http.StatusForbidden)
+			return
+		}
+		token := []byte("Bearer " + a.opts.AdminToken)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+			httpError(w, r, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// serveHealthz replies 200, or 503 until the first push cycle completes
+// with WaitFirstScrape.
+func (a *Application) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	if a.opts.WaitFirstScrape {
+		select {
+		case <-a.ready:
+		default:
+			httpError(w, r, "waiting for the first scrape", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+func (a *Application) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		httpError(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		status = http.StatusOK
+		data   dict
+	)
+	if err := a.Reload(); err != nil {
+		appLog("reload").WithError(err).Warn("Config reload failure")
+		var problems ConfigErrors
+		if !errors.As(err, &problems) {
+			problems = ConfigErrors{err}
+		}
+		msgs := make([]string, len(problems))
+		for i, p := range problems {
+			msgs[i] = p.Error()
+		}
+		status, data = http.StatusBadRequest, dict{"errors": msgs}
+	} else {
+		config := a.Config()
+		data = dict{
+			"monitors": len(config.Monitors),
+			"sources":  len(config.Sources),
+			"graphs":   len(config.Graphs),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		appLog("reload").WithError(err).Error("can't encode data")
+	}
+}
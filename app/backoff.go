@@ -0,0 +1,96 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// sourceBackoffFailures is the number of consecutive failures of a source
+// after which its pulls back off.
+var sourceBackoffFailures = 3
+
+// sourceBackoffMax caps the delay between the pulls of a failing source.
+var sourceBackoffMax = 5 * time.Minute
+
+// sourceBackoff delays the pulls of the sources failing repeatedly: after
+// sourceBackoffFailures consecutive failures, a source is pulled after a
+// delay doubled on every further failure, from twice the refresh period up
+// to sourceBackoffMax, jittered within its upper half. A success resumes
+// the refresh cadence. The tunables are read when the backoff is made.
+type sourceBackoff struct {
+	mu       sync.Mutex
+	refresh  time.Duration
+	failures int
+	max      time.Duration
+	states   map[string]*backoffState
+}
+
+type backoffState struct {
+	failures int
+	next     time.Time
+}
+
+func newSourceBackoff(refresh time.Duration) *sourceBackoff {
+	return &sourceBackoff{
+		refresh:  refresh,
+		failures: sourceBackoffFailures,
+		max:      sourceBackoffMax,
+		states:   map[string]*backoffState{},
+	}
+}
+
+// skip tells whether the source is backing off, a nil backoff never does.
+func (b *sourceBackoff) skip(id string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.states[id]
+	return ok && time.Now().Before(st.next)
+}
+
+// done records the outcome of a source pull and returns its consecutive
+// failures and the delay before its next pull, zero when not backing off.
+// The jitter function returns a random delay below its argument.
+func (b *sourceBackoff) done(id string, err error, jitter func(time.Duration) time.Duration) (int, time.Duration) {
+	if b == nil {
+		return 0, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.states, id)
+		return 0, 0
+	}
+	st, ok := b.states[id]
+	if !ok {
+		st = &backoffState{}
+		b.states[id] = st
+	}
+	st.failures++
+	if st.failures < b.failures {
+		return st.failures, 0
+	}
+
+	delay := 2 * b.refresh
+	for i := b.failures; i < st.failures && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	delay = delay/2 + jitter(delay/2)
+	st.next = time.Now().Add(delay)
+	return st.failures, delay
+}
+
+// quiet tells whether a failure is logged at a reduced rate: once backing
+// off, only the failures numbered by a power of two are. A nil backoff
+// never backs off, so is never quiet.
+func (b *sourceBackoff) quiet(failures int) bool {
+	if b == nil {
+		return false
+	}
+	return failures > b.failures && failures&(failures-1) != 0
+}
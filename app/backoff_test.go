@@ -0,0 +1,74 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_sourceBackoff_done(t *testing.T) {
+	none := func(time.Duration) time.Duration { return 0 }
+	b := newSourceBackoff(5 * time.Second)
+	b.failures, b.max = 3, time.Minute
+	fail := errors.New("down")
+
+	var delays []time.Duration
+	for i := 0; i < 8; i++ {
+		_, delay := b.done("router", fail, none)
+		delays = append(delays, delay)
+	}
+	assert.Equal(t, []time.Duration{
+		0, 0,
+		5 * time.Second,
+		10 * time.Second,
+		20 * time.Second,
+		30 * time.Second,
+		30 * time.Second,
+		30 * time.Second,
+	}, delays)
+	assert.True(t, b.skip("router"))
+	assert.False(t, b.skip("modem"))
+
+	failures, delay := b.done("router", nil, none)
+	assert.Equal(t, 0, failures)
+	assert.Zero(t, delay)
+	assert.False(t, b.skip("router"))
+
+	var quiet []int
+	for failures := 1; failures <= 10; failures++ {
+		if !b.quiet(failures) {
+			quiet = append(quiet, failures)
+		}
+	}
+	assert.Equal(t, []int{1, 2, 3, 4, 8}, quiet)
+
+	var nilBackoff *sourceBackoff
+	assert.False(t, nilBackoff.skip("router"))
+	assert.False(t, nilBackoff.quiet(8))
+}
+
+func Test_WatchService_Start_backoff(t *testing.T) {
+	ws := newWatchService()
+	up := &Source{command: &testCommand{}, parser: &testParser{}}
+	up.c.Id = "up"
+	down := &Source{command: &testCommand{err: errors.New("down")}, parser: &testParser{}}
+	down.c.Id = "down"
+	ws.sources = []*Source{up, down}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	ws.Start(ctx, 5*time.Millisecond)
+
+	pulls := func(s *Source) int {
+		c := s.command.(*testCommand)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.executed)
+	}
+	assert.Greater(t, pulls(up), 20)
+	assert.Less(t, pulls(down), pulls(up)/2)
+	assert.Equal(t, "down", ws.SourcesStatus()[1].LastError.Error())
+}
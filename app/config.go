@@ -1,21 +1,35 @@
 package app
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
 	"github.com/realitycheck/watchmon/pkg/yamlutil"
-	log "github.com/sirupsen/logrus"
 	"github.com/xeipuuv/gojsonschema"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 //go:embed schemas/*.json
 var schemas embed.FS
 
+//go:embed examples/*.yaml
+var examples embed.FS
+
 var AppConfigSchema string
 
 func init() {
@@ -37,42 +51,324 @@ func (d *dict) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// DefaultTimeout is the source timeout used when neither the source nor
+// the configuration defines one.
+const DefaultTimeout = 10 * time.Second
+
+// DefaultRefreshPeriod is the source refresh period used when neither the
+// run options nor the configuration define one.
+const DefaultRefreshPeriod = 1 * time.Second
+
 type AppConfig struct {
-	Monitors []MonitorConfig `yaml:"monitors"`
-	Sources  []SourceConfig  `yaml:"sources"`
-	Graphs   []GraphConfig   `yaml:"graphs"`
+	DefaultTimeout time.Duration     `yaml:"defaultTimeout"`
+	RefreshPeriod  time.Duration     `yaml:"refreshPeriod"`
+	Jitter         time.Duration     `yaml:"jitter"`
+	Monitors       []MonitorConfig   `yaml:"monitors"`
+	Sources        []SourceConfig    `yaml:"sources"`
+	Graphs         []GraphConfig     `yaml:"graphs"`
+	UI             UIConfig          `yaml:"ui"`
+	Pushgateway    PushgatewayConfig `yaml:"pushgateway"`
+	Textfile       TextfileConfig    `yaml:"textfile"`
+
+	// Exporter is where the monitors metrics go, "prometheus" to serve
+	// them (the default) or "otlp" to export them to the OTLP endpoint.
+	Exporter string     `yaml:"exporter"`
+	OTLP     OTLPConfig `yaml:"otlp"`
+
+	// MaxCardinality caps the number of series of every monitor, new
+	// label sets over the cap are not written. No cap when zero.
+	MaxCardinality int `yaml:"maxCardinality"`
+
+	// MetricsPath is where the metrics are served, DefaultMetricsPath
+	// when empty.
+	MetricsPath string `yaml:"metricsPath"`
+}
+
+// DefaultMetricsPath is the metrics path used when the config sets none.
+const DefaultMetricsPath = "/metrics"
+
+// reservedPaths are served by the dashboard, not available as metrics path.
+var reservedPaths = map[string]bool{
+	"/":            true,
+	"/config.json": true,
+	"/config.yaml": true,
+	"/sources":     true,
+	"/ws":          true,
+	"/reload":      true,
+	"/healthz":     true,
+}
+
+// metricsPath returns the config metrics path or DefaultMetricsPath.
+func (c AppConfig) metricsPath() string {
+	if c.MetricsPath == "" {
+		return DefaultMetricsPath
+	}
+	return c.MetricsPath
+}
+
+// PushgatewayConfig enables pushing the metrics to the Pushgateway at URL
+// after every watch cycle, grouped by Job and the Grouping labels. A push
+// failing is retried up to Retries times with a doubling delay.
+type PushgatewayConfig struct {
+	URL      string            `yaml:"url"`
+	Job      string            `yaml:"job"`
+	Grouping map[string]string `yaml:"grouping,omitempty"`
+	Retries  int               `yaml:"retries"`
+}
+
+// TextfileConfig enables writing the metrics to the file at Path after
+// every watch cycle, for the node_exporter textfile collector. A non-zero
+// Interval writes the file at most once per interval.
+type TextfileConfig struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// OTLPConfig configures the OTLP exporter, exporting the metrics over
+// HTTP to the Endpoint URL every Interval with the Headers set. The OTel
+// SDK defaults and OTEL_EXPORTER_OTLP_* environment apply to the fields
+// left empty.
+type OTLPConfig struct {
+	Endpoint string            `yaml:"endpoint"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	Interval time.Duration     `yaml:"interval"`
 }
 
+// DefaultUITitle is the dashboard title used when the config sets none.
+const DefaultUITitle = "Watchmon"
+
+// UIConfig brands the dashboard with a Title, a Logo image URL shown
+// next to it and a Footer line.
+type UIConfig struct {
+	Title  string `yaml:"title"`
+	Logo   string `yaml:"logo"`
+	Footer string `yaml:"footer"`
+}
+
+// SourceLabel is the label name added by MonitorConfig.AddSourceLabel.
+const SourceLabel = "source"
+
 type MonitorConfig struct {
-	Id    string             `yaml:"id"`
-	Title string             `yaml:"title"`
-	Type  string             `yaml:"type"`
-	Value MonitorValueConfig `yaml:"value"`
+	Id         string             `yaml:"id"`
+	Title      string             `yaml:"title"`
+	Type       string             `yaml:"type"`
+	MetricName string             `yaml:"metricName"`
+	Value      MonitorValueConfig `yaml:"value"`
+
+	// NoDataPolicy is what happens to the series missing from a source
+	// pull: "keep" (the default) their last value, set them to "zero" or
+	// "delete" them.
+	NoDataPolicy string `yaml:"noDataPolicy"`
+
+	// AddSourceLabel adds a 'source' label with the value source id to
+	// every series of the monitor.
+	AddSourceLabel bool `yaml:"addSourceLabel"`
+}
+
+// metricName returns the exposed metric name, the monitor id by default,
+// sanitized to a valid Prometheus metric name.
+func (c *MonitorConfig) metricName() string {
+	if c.MetricName != "" {
+		return sanitizeName(c.MetricName, true)
+	}
+	return sanitizeName(c.Id, true)
 }
 
+// closestName returns the name within an edit distance of 2 of s, if any.
+func closestName(s string, names []string) string {
+	res, best := "", 3
+	for _, name := range names {
+		if d := editDistance(s, name); d < best {
+			res, best = name, d
+		}
+	}
+	return res
+}
+
+// editDistance is the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// sanitizeName replaces the characters invalid in a Prometheus name by
+// '_', colons are valid in metric names only. A leading digit gets a '_'
+// prefix and leading underscores are collapsed as '__' is reserved.
+func sanitizeName(name string, colons bool) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':' && colons:
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	res := b.String()
+	if strings.HasPrefix(res, "__") {
+		res = "_" + strings.TrimLeft(res, "_")
+	}
+	return res
+}
+
+// MonitorValueConfig defines where a monitor value comes from. The record
+// Header field is looked up in ValueMap first and, when no entry matches,
+// parsed according to ValueType: scanned with Format by default, as a
+// duration in seconds or as a TimeLayout timestamp in unix seconds.
+// With TimestampHeader, the sample time is read from that record field
+// with the TimestampFormat layout and exposed instead of the scrape time.
 type MonitorValueConfig struct {
-	SourceId string                    `yaml:"sourceId"`
-	RecordId string                    `yaml:"recordId"`
-	Header   string                    `yaml:"header"`
-	Format   string                    `yaml:"format"`
-	Labels   []MonitorValueLabelConfig `yaml:"labels"`
+	SourceId        string                    `yaml:"sourceId"`
+	RecordId        string                    `yaml:"recordId"`
+	Header          string                    `yaml:"header"`
+	Format          string                    `yaml:"format"`
+	ValueType       string                    `yaml:"valueType"`
+	TimeLayout      string                    `yaml:"timeLayout"`
+	ValueMap        map[string]float64        `yaml:"valueMap,omitempty"`
+	TimestampHeader string                    `yaml:"timestampHeader"`
+	TimestampFormat string                    `yaml:"timestampFormat"`
+	Labels          []MonitorValueLabelConfig `yaml:"labels"`
+	OmitMissing     bool                      `yaml:"omitMissing"`
+
+	// Rate writes the per-second change of the value since the previous
+	// pull instead of the value. Decreasing values are counter resets and
+	// skipped.
+	Rate bool `yaml:"rate"`
+
+	// Aggregate reduces the values of all the record rows to a single
+	// one: sum, avg, min, max or count. Only for a value without labels.
+	Aggregate string `yaml:"aggregate"`
+
+	// DecimalSeparator, "." or ",", normalizes the value before it is
+	// scanned: the other separator is taken as a thousands separator and
+	// removed, and a decimal comma becomes a dot. No normalization when
+	// empty.
+	DecimalSeparator string `yaml:"decimalSeparator"`
 }
 
+// aggregations are the MonitorValueConfig.Aggregate values.
+var aggregations = map[string]bool{"sum": true, "avg": true, "min": true, "max": true, "count": true}
+
+// MonitorValueLabelConfig defines a label named by Header. Its value is
+// the record Header field, scanned with Format if set, or the Template
+// rendered against the whole record.
 type MonitorValueLabelConfig struct {
-	Header string `yaml:"header"`
-	Format string `yaml:"format"`
+	Header   string `yaml:"header"`
+	Format   string `yaml:"format"`
+	Template string `yaml:"template"`
 }
 
 type SourceConfig struct {
-	Id      string             `yaml:"id"`
-	Command string             `yaml:"command"`
-	Timeout time.Duration      `yaml:"timeout"`
-	Output  SourceOutputConfig `yaml:"output"`
+	Id                 string             `yaml:"id"`
+	Type               string             `yaml:"type"`
+	Command            string             `yaml:"command"`
+	Commands           []string           `yaml:"commands,omitempty"`
+	File               string             `yaml:"file"`
+	Addr               string             `yaml:"addr"`
+	Request            string             `yaml:"request"`
+	Method             string             `yaml:"method"`
+	Body               string             `yaml:"body"`
+	ContentType        string             `yaml:"contentType"`
+	Steps              []HTTPStepConfig   `yaml:"steps,omitempty"`
+	InsecureSkipVerify bool               `yaml:"insecureSkipVerify"`
+	CACertFile         string             `yaml:"caCertFile"`
+	Delimiter          string             `yaml:"delimiter"`
+	Stream             bool               `yaml:"stream"`
+	Timeout            time.Duration      `yaml:"timeout"`
+	Jitter             time.Duration      `yaml:"jitter"`
+	Decompress         string             `yaml:"decompress"`
+	Encoding           string             `yaml:"encoding"`
+	Transform          string             `yaml:"transform"`
+	RunAsUser          string             `yaml:"runAsUser"`
+	RunAsGroup         string             `yaml:"runAsGroup"`
+	DependsOn          SourceDependency   `yaml:"dependsOn"`
+	Output             SourceOutputConfig `yaml:"output"`
+}
+
+// HTTPStepConfig is a request made by an http source before its own,
+// e.g. a login setting the session cookie. The steps of a pull share
+// their cookies.
+type HTTPStepConfig struct {
+	Addr        string `yaml:"addr"`
+	Method      string `yaml:"method"`
+	Body        string `yaml:"body"`
+	ContentType string `yaml:"contentType"`
+}
+
+// SourceDependency makes the source command a template executed once per
+// row of the RecordId records of the SourceId source, the row values
+// expanded as shell quoted words.
+type SourceDependency struct {
+	SourceId string `yaml:"sourceId"`
+	RecordId string `yaml:"recordId"`
 }
 
 type SourceOutputConfig struct {
 	Parser  string               `yaml:"parser"`
 	Records []ParserRecordConfig `yaml:"records"`
+
+	// Stages parse parts of a mixed output each with its own parser, their
+	// records merged with the Records of Parser, which then parses the
+	// whole output only when set.
+	Stages []OutputStageConfig `yaml:"stages,omitempty"`
+}
+
+// parserNames returns the output parser and the stage parsers, joined by
+// '+'.
+func (c SourceOutputConfig) parserNames() string {
+	var names []string
+	if c.Parser != "" {
+		names = append(names, c.Parser)
+	}
+	for _, st := range c.Stages {
+		names = append(names, st.Parser)
+	}
+	return strings.Join(names, "+")
+}
+
+// OutputStageConfig parses the part of the source output within the
+// Length bytes from Offset, to the end when zero, and then after the line
+// holding the Start marker and before the End marker, when set. A missing
+// Start marker fails the pull, a missing End marker extends the part to
+// the end.
+type OutputStageConfig struct {
+	Parser  string               `yaml:"parser"`
+	Offset  int                  `yaml:"offset"`
+	Length  int                  `yaml:"length"`
+	Start   string               `yaml:"start"`
+	End     string               `yaml:"end"`
+	Records []ParserRecordConfig `yaml:"records"`
 }
 
 type ParserRecordConfig struct {
@@ -80,14 +376,393 @@ type ParserRecordConfig struct {
 	FirstLineIsHeader bool              `yaml:"firstLineIsHeader"`
 	Header            []string          `yaml:"header"`
 	ParserOptions     map[string]string `yaml:"parserOptions"`
+
+	// HeaderPattern keeps only the columns of the header line matching
+	// the regexp, the first line must be the header.
+	HeaderPattern string `yaml:"headerPattern"`
+
+	// StrictHeader fails the parse when the header line differs from
+	// Header, so a reordered source doesn't map values to wrong keys.
+	StrictHeader bool `yaml:"strictHeader"`
 }
 
+// DefaultChartDelay is the graph chart delay in milliseconds used when
+// a graph doesn't define one.
+const DefaultChartDelay = 1000
+
 type GraphConfig struct {
 	Id            string          `yaml:"id"`
 	ChartDelay    int             `yaml:"chartDelay"`
 	ChartOptions  dict            `yaml:"chartOptions"`
 	SeriesOptions map[string]dict `yaml:"seriesOptions"`
 	TimeOptions   map[string]dict `yaml:"timeOptions"`
+
+	// MaxSeries caps the number of label sets of the graph monitor, the
+	// first ones in label order are kept. No cap when zero.
+	MaxSeries int `yaml:"maxSeries"`
+	// Palette colors the series in order unless their seriesOptions set
+	// a strokeStyle.
+	Palette []string `yaml:"palette,omitempty"`
+	// RetentionSeconds and MaxPoints bound the data the dashboard keeps
+	// per series, by age and by count. No bound when zero.
+	RetentionSeconds int `yaml:"retentionSeconds"`
+	MaxPoints        int `yaml:"maxPoints"`
+	// Monitors lists the monitors drawn together on the graph canvas,
+	// the monitor with the graph id when empty.
+	Monitors []string `yaml:"monitors,omitempty"`
+	// YMin and YMax bound the y axis, fitted to the values when unset.
+	// LogScale draws the values on a log10 scale and Stacked stacks the
+	// series on top of each other.
+	YMin     *float64 `yaml:"yMin,omitempty"`
+	YMax     *float64 `yaml:"yMax,omitempty"`
+	LogScale bool     `yaml:"logScale"`
+	Stacked  bool     `yaml:"stacked"`
+}
+
+// monitorIds returns the ids of the monitors drawn on the graph.
+func (g GraphConfig) monitorIds() []string {
+	if len(g.Monitors) > 0 {
+		return g.Monitors
+	}
+	return []string{g.Id}
+}
+
+// ConfigErrors is a list of problems found in a configuration.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// FieldError is a schema violation at a config field path.
+type FieldError struct {
+	Field       string
+	Description string
+}
+
+func newFieldError(re gojsonschema.ResultError) *FieldError {
+	field, desc := re.Field(), re.Description()
+	if re.Type() == "required" {
+		if field == gojsonschema.STRING_ROOT_SCHEMA_PROPERTY {
+			field = ""
+		} else {
+			field += "."
+		}
+		field += fmt.Sprintf("%v", re.Details()["property"])
+		desc = "required"
+	}
+	return &FieldError{field, desc}
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Description
+}
+
+// SchemaError reports every schema violation of a config file. Its
+// message holds the first one, Unwrap returns the full list.
+type SchemaError struct {
+	Filename   string
+	Violations ConfigErrors
+}
+
+func (e *SchemaError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Filename, e.Violations[0])
+	if len(e.Violations) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(e.Violations)-1)
+	}
+	return msg
+}
+
+func (e *SchemaError) Unwrap() error {
+	return e.Violations
+}
+
+// Validate runs the cross-reference checks the schema can't express:
+// unique ids and existing source/record references. It returns
+// ConfigErrors listing every problem found, or nil.
+func (c *AppConfig) Validate() error {
+	var errs ConfigErrors
+
+	if p := c.MetricsPath; p != "" {
+		switch {
+		case !strings.HasPrefix(p, "/"):
+			errs = append(errs, fmt.Errorf("metricsPath: must start with /, got %q", p))
+		case reservedPaths[p] || strings.HasPrefix(p, "/static/"):
+			errs = append(errs, fmt.Errorf("metricsPath: conflicts with the dashboard path %q", p))
+		}
+	}
+
+	if e := c.OTLP.Endpoint; e != "" {
+		if u, err := url.Parse(e); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("otlp.endpoint: must be an http or https URL, got %q", e))
+		}
+	}
+
+	sources := map[string]map[string]bool{}
+	for i, s := range c.Sources {
+		if _, ok := sources[s.Id]; ok {
+			errs = append(errs, fmt.Errorf("sources.%d.id: duplicate source id %q", i, s.Id))
+			continue
+		}
+		records := map[string]bool{}
+		validateRecords := func(path, parser string, rr []ParserRecordConfig) {
+			for j, r := range rr {
+				if records[r.Id] {
+					errs = append(errs, fmt.Errorf("%s.records.%d.id: duplicate record id %q", path, j, r.Id))
+				}
+				records[r.Id] = true
+				if parser == "htmlquery" {
+					if err := (&htmlqueryParser{}).validate(&r); err != nil {
+						errs = append(errs, fmt.Errorf("%s.records.%d.parserOptions: record %q: %v", path, j, r.Id, err))
+					}
+				}
+				if r.HeaderPattern != "" {
+					if _, err := regexp.Compile(r.HeaderPattern); err != nil {
+						errs = append(errs, fmt.Errorf("%s.records.%d.headerPattern: %v", path, j, err))
+					} else if !r.FirstLineIsHeader {
+						errs = append(errs, fmt.Errorf("%s.records.%d.headerPattern: requires firstLineIsHeader", path, j))
+					}
+				}
+				if r.StrictHeader && (!r.FirstLineIsHeader || len(r.Header) == 0) {
+					errs = append(errs, fmt.Errorf("%s.records.%d.strictHeader: requires firstLineIsHeader and header", path, j))
+				}
+			}
+		}
+		unknownParser := func(path, parser string) {
+			msg := fmt.Sprintf("%s.parser: unknown parser %q", path, parser)
+			if name := closestName(parser, parserNames()); name != "" {
+				msg += fmt.Sprintf(" (did you mean %q?)", name)
+			}
+			errs = append(errs, errors.New(msg))
+		}
+		if s.Output.Parser != "" && newParser(s.Output.Parser) == nil {
+			unknownParser(fmt.Sprintf("sources.%d.output", i), s.Output.Parser)
+		}
+		validateRecords(fmt.Sprintf("sources.%d.output", i), s.Output.Parser, s.Output.Records)
+		for j, st := range s.Output.Stages {
+			path := fmt.Sprintf("sources.%d.output.stages.%d", i, j)
+			if newParser(st.Parser) == nil {
+				unknownParser(path, st.Parser)
+			}
+			validateRecords(path, st.Parser, st.Records)
+		}
+		sources[s.Id] = records
+
+		if s.Type != "" && newCommand(s.Type) == nil {
+			msg := fmt.Sprintf("sources.%d.type: unknown source type %q", i, s.Type)
+			if name := closestName(s.Type, commandNames()); name != "" {
+				msg += fmt.Sprintf(" (did you mean %q?)", name)
+			}
+			errs = append(errs, errors.New(msg))
+		}
+		if s.Command != "" && len(s.Commands) > 0 {
+			errs = append(errs, fmt.Errorf("sources.%d.commands: conflicts with command", i))
+		}
+		if s.RunAsUser != "" {
+			if _, _, err := lookupUser(s.RunAsUser); err != nil {
+				errs = append(errs, fmt.Errorf("sources.%d.runAsUser: %v", i, err))
+			}
+		}
+		if s.RunAsGroup != "" {
+			if _, err := lookupGroup(s.RunAsGroup); err != nil {
+				errs = append(errs, fmt.Errorf("sources.%d.runAsGroup: %v", i, err))
+			}
+		}
+		if s.Encoding != "" {
+			if _, err := htmlindex.Get(s.Encoding); err != nil {
+				errs = append(errs, fmt.Errorf("sources.%d.encoding: unknown encoding %q", i, s.Encoding))
+			}
+		}
+	}
+
+	dependsOn := map[string]string{}
+	for i, s := range c.Sources {
+		dep := s.DependsOn
+		if dep.SourceId == "" {
+			continue
+		}
+		dependsOn[s.Id] = dep.SourceId
+		if records, ok := sources[dep.SourceId]; !ok {
+			errs = append(errs, fmt.Errorf("sources.%d.dependsOn.sourceId: unknown source id %q", i, dep.SourceId))
+		} else if !records[dep.RecordId] {
+			errs = append(errs, fmt.Errorf("sources.%d.dependsOn.recordId: unknown record id %q in source %q", i, dep.RecordId, dep.SourceId))
+		}
+		if _, err := template.New(s.Id).Parse(s.Command); err != nil {
+			errs = append(errs, fmt.Errorf("sources.%d.command: %v", i, err))
+		}
+		for j, command := range s.Commands {
+			if _, err := template.New(s.Id).Parse(command); err != nil {
+				errs = append(errs, fmt.Errorf("sources.%d.commands.%d: %v", i, j, err))
+			}
+		}
+	}
+	for i, s := range c.Sources {
+		for id, n := dependsOn[s.Id], 0; id != ""; id, n = dependsOn[id], n+1 {
+			if id == s.Id || n > len(c.Sources) {
+				errs = append(errs, fmt.Errorf("sources.%d.dependsOn.sourceId: dependency cycle on source %q", i, s.Id))
+				break
+			}
+		}
+	}
+
+	monitors := map[string]bool{}
+	for i, m := range c.Monitors {
+		if monitors[m.Id] {
+			errs = append(errs, fmt.Errorf("monitors.%d.id: duplicate monitor id %q", i, m.Id))
+		}
+		monitors[m.Id] = true
+
+		if m.Type != "" && newMetric(m.Type) == nil {
+			msg := fmt.Sprintf("monitors.%d.type: unknown monitor type %q", i, m.Type)
+			if name := closestName(m.Type, metricNames()); name != "" {
+				msg += fmt.Sprintf(" (did you mean %q?)", name)
+			}
+			errs = append(errs, errors.New(msg))
+		}
+
+		for j, l := range m.Value.Labels {
+			if _, err := template.New(l.Header).Parse(l.Template); err != nil {
+				errs = append(errs, fmt.Errorf("monitors.%d.value.labels.%d.template: %v", i, j, err))
+			}
+			if m.AddSourceLabel && sanitizeName(l.Header, false) == SourceLabel {
+				errs = append(errs, fmt.Errorf("monitors.%d.value.labels.%d.header: conflicts with addSourceLabel", i, j))
+			}
+		}
+
+		if m.Value.Aggregate != "" {
+			if !aggregations[m.Value.Aggregate] {
+				errs = append(errs, fmt.Errorf("monitors.%d.value.aggregate: unknown aggregation %q", i, m.Value.Aggregate))
+			}
+			if len(m.Value.Labels) > 0 {
+				errs = append(errs, fmt.Errorf("monitors.%d.value.aggregate: requires no labels", i))
+			}
+		}
+
+		records, ok := sources[m.Value.SourceId]
+		if !ok {
+			errs = append(errs, fmt.Errorf("monitors.%d.value.sourceId: unknown source id %q", i, m.Value.SourceId))
+		} else if !records[m.Value.RecordId] {
+			errs = append(errs, fmt.Errorf("monitors.%d.value.recordId: unknown record id %q in source %q", i, m.Value.RecordId, m.Value.SourceId))
+		}
+	}
+
+	graphs := map[string]bool{}
+	for i, g := range c.Graphs {
+		if graphs[g.Id] {
+			errs = append(errs, fmt.Errorf("graphs.%d.id: duplicate graph id %q", i, g.Id))
+		}
+		graphs[g.Id] = true
+
+		if g.YMin != nil && g.YMax != nil && *g.YMax <= *g.YMin {
+			errs = append(errs, fmt.Errorf("graphs.%d.yMax: must be greater than yMin %v, got %v", i, *g.YMin, *g.YMax))
+		}
+		if g.LogScale && g.YMin != nil && *g.YMin <= 0 {
+			errs = append(errs, fmt.Errorf("graphs.%d.yMin: must be positive with logScale, got %v", i, *g.YMin))
+		}
+
+		if len(g.Monitors) == 0 {
+			if !monitors[g.Id] {
+				errs = append(errs, fmt.Errorf("graphs.%d.id: unknown monitor id %q", i, g.Id))
+			}
+			continue
+		}
+		if monitors[g.Id] {
+			errs = append(errs, fmt.Errorf("graphs.%d.id: conflicts with monitor id %q", i, g.Id))
+		}
+		for j, id := range g.Monitors {
+			if !monitors[id] {
+				errs = append(errs, fmt.Errorf("graphs.%d.monitors.%d: unknown monitor id %q", i, j, id))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Resolved returns the config in effect when run, with the defaults
+// applied to the fields it leaves empty.
+func (c AppConfig) Resolved() AppConfig {
+	res := c
+	if res.DefaultTimeout == 0 {
+		res.DefaultTimeout = DefaultTimeout
+	}
+	if res.RefreshPeriod == 0 {
+		res.RefreshPeriod = DefaultRefreshPeriod
+	}
+	res.MetricsPath = c.metricsPath()
+	if c.Pushgateway.URL != "" && res.Pushgateway.Job == "" {
+		res.Pushgateway.Job = DefaultPushgatewayJob
+	}
+	res.UI = makeUIConfig(c)
+
+	res.Monitors = make([]MonitorConfig, len(c.Monitors))
+	for i, m := range c.Monitors {
+		m.setDefaults()
+		res.Monitors[i] = m
+	}
+	res.Sources = make([]SourceConfig, len(c.Sources))
+	for i, s := range c.Sources {
+		s.setDefaults(c)
+		res.Sources[i] = s
+	}
+	if c.Graphs != nil {
+		res.Graphs = make([]GraphConfig, len(c.Graphs))
+		for i, g := range c.Graphs {
+			if g.ChartDelay == 0 {
+				g.ChartDelay = DefaultChartDelay
+			}
+			res.Graphs[i] = g
+		}
+	}
+	return res
+}
+
+// setDefaults fills the monitor fields left empty.
+func (m *MonitorConfig) setDefaults() {
+	if m.Value.Format == "" {
+		m.Value.Format = "%f"
+	}
+	if m.Type == "" {
+		m.Type = "gauge"
+	}
+}
+
+// setDefaults fills the source fields left empty, from the config ones
+// first. The type is guessed from the fields set.
+func (s *SourceConfig) setDefaults(config AppConfig) {
+	if s.Timeout == 0 {
+		s.Timeout = config.DefaultTimeout
+	}
+	if s.Timeout == 0 {
+		s.Timeout = DefaultTimeout
+	}
+	if s.Jitter == 0 {
+		s.Jitter = config.Jitter
+	}
+
+	if s.Type == "" {
+		switch {
+		case s.File != "":
+			s.Type = "file"
+		case strings.HasPrefix(s.Addr, "tcp://"):
+			s.Type = "tcp"
+		case strings.HasPrefix(s.Addr, "unix://"):
+			s.Type = "unix"
+		case strings.HasPrefix(s.Addr, "http://"), strings.HasPrefix(s.Addr, "https://"):
+			s.Type = "http"
+		case s.Stream:
+			s.Type = "stream"
+		default:
+			s.Type = "shell"
+		}
+	}
 }
 
 func (c *AppConfig) MonitorsMap() map[string]*MonitorConfig {
@@ -99,41 +774,267 @@ func (c *AppConfig) MonitorsMap() map[string]*MonitorConfig {
 	return res
 }
 
+// Hash returns a short digest of the configuration.
+func (c AppConfig) Hash() string {
+	bytes, err := yaml.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(bytes)
+	return hex.EncodeToString(sum[:8])
+}
+
+// ExampleConfig returns a commented example config for the parser.
+func ExampleConfig(parser string) ([]byte, error) {
+	data, err := examples.ReadFile("examples/" + parser + ".yaml")
+	if err != nil {
+		return nil, fmt.Errorf("no example config for parser %q", parser)
+	}
+	return data, nil
+}
+
+// Save writes the config to filename, creating its parent directories,
+// and refuses to write a config that wouldn't load back.
 func (c AppConfig) Save(filename string) error {
 	bytes, err := yaml.Marshal(c)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filename, bytes, 0777)
+	if err := ValidateConfigData(filename, bytes); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, bytes, 0644)
+}
+
+// ValidateConfigData checks that data is a config that loads from
+// filename, valid against the schema and consistent.
+func ValidateConfigData(filename string, data []byte) error {
+	config, err := parseConfig(filename, data, LoadConfigOptions{})
+	if err != nil {
+		return err
+	}
+	return config.Validate()
+}
+
+// LoadConfigOptions controls how LoadConfigWithOptions reads a config.
+type LoadConfigOptions struct {
+	// NoValidate skips the schema validation, so config fields unknown
+	// to the schema are ignored instead of rejected.
+	NoValidate bool
 }
 
 func LoadConfig(filename string) (AppConfig, error) {
-	var appConfig AppConfig
-	bytes, err := os.ReadFile(filename)
+	return LoadConfigWithOptions(filename, LoadConfigOptions{})
+}
+
+// LoadConfigWithOptions loads the config from filename, which is a local
+// path, "-" for stdin or an http(s) URL. A local directory loads all its
+// *.yaml and *.yml files merged into one config.
+func LoadConfigWithOptions(filename string, opts LoadConfigOptions) (AppConfig, error) {
+	if fi, err := os.Stat(filename); err == nil && fi.IsDir() {
+		return loadConfigDir(filename, opts)
+	}
+	data, err := readConfig(filename)
 	if err != nil {
-		return appConfig, err
-	}
-
-	err = yaml.Unmarshal(bytes, &appConfig)
-	if err == nil {
-		var result *gojsonschema.Result
-		var document dict
-		err = yaml.Unmarshal(bytes, &document)
-		if err == nil {
-			result, err = gojsonschema.Validate(
-				gojsonschema.NewStringLoader(AppConfigSchema),
-				gojsonschema.NewGoLoader(document),
-			)
-			if err == nil && !result.Valid() {
-				err = fmt.Errorf("%s: %s", filename, result.Errors()[0])
-				logger := configLog("LoadConfig")
-				if logger.Logger.IsLevelEnabled(log.DebugLevel) {
-					for _, desc := range result.Errors() {
-						logger.Errorf(" - %s\n", desc)
-					}
-				}
+		return AppConfig{}, err
+	}
+	return parseConfig(filename, data, opts)
+}
+
+// loadConfigDir loads the YAML files of dir in name order.
+func loadConfigDir(dir string, opts LoadConfigOptions) (AppConfig, error) {
+	var files []configFile
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return AppConfig{}, err
+	}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return AppConfig{}, err
+		}
+		files = append(files, configFile{e.Name(), data})
+	}
+	if len(files) == 0 {
+		return AppConfig{}, fmt.Errorf("%s: no config files", dir)
+	}
+	return parseConfigFiles(dir, files, opts)
+}
+
+// stdin is where a "-" config is read from.
+var stdin io.Reader = os.Stdin
+
+func readConfig(filename string) ([]byte, error) {
+	switch {
+	case filename == "-":
+		return io.ReadAll(stdin)
+	case strings.HasPrefix(filename, "http://"), strings.HasPrefix(filename, "https://"):
+		client := http.Client{Timeout: DefaultTimeout}
+		resp, err := client.Get(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: unexpected status %s", filename, resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	default:
+		return os.ReadFile(filename)
+	}
+}
+
+// configFile is a named config file data of a config directory.
+type configFile struct {
+	name string
+	data []byte
+}
+
+// parseConfig decodes every YAML document of data, merges them into one
+// configuration and validates the merged result against the schema.
+func parseConfig(filename string, data []byte, opts LoadConfigOptions) (AppConfig, error) {
+	return parseConfigFiles(filename, []configFile{{"", data}}, opts)
+}
+
+// parseConfigFiles is parseConfig over the documents of several files.
+func parseConfigFiles(filename string, files []configFile, opts LoadConfigOptions) (AppConfig, error) {
+	var (
+		appConfig AppConfig
+		document  = dict{}
+	)
+	for _, f := range files {
+		prefix := filename + ": "
+		if f.name != "" {
+			prefix += f.name + ": "
+		}
+		configs := yaml.NewDecoder(bytes.NewReader(f.data))
+		documents := yaml.NewDecoder(bytes.NewReader(f.data))
+		for i := 0; ; i++ {
+			var c AppConfig
+			err := configs.Decode(&c)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return appConfig, err
+			}
+			if err := appConfig.merge(c); err != nil {
+				return appConfig, fmt.Errorf("%sdocument %d: %v", prefix, i, err)
+			}
+
+			var d dict
+			if err := documents.Decode(&d); err != nil {
+				return appConfig, err
+			}
+			document.merge(d)
+		}
+	}
+
+	if !opts.NoValidate {
+		result, err := gojsonschema.Validate(
+			gojsonschema.NewStringLoader(AppConfigSchema),
+			gojsonschema.NewGoLoader(document),
+		)
+		if err != nil {
+			return appConfig, err
+		}
+		if !result.Valid() {
+			violations := make(ConfigErrors, len(result.Errors()))
+			for i, re := range result.Errors() {
+				violations[i] = newFieldError(re)
+			}
+			return appConfig, &SchemaError{filename, violations}
+		}
+	}
+	return appConfig, nil
+}
+
+// merge appends the monitors, sources and graphs of other, rejecting ids
+// already defined, and takes its non-zero top-level settings.
+func (c *AppConfig) merge(other AppConfig) error {
+	monitors := c.MonitorsMap()
+	for _, m := range other.Monitors {
+		if _, ok := monitors[m.Id]; ok {
+			return fmt.Errorf("duplicate monitor id %q", m.Id)
+		}
+	}
+	sources := map[string]bool{}
+	for _, s := range c.Sources {
+		sources[s.Id] = true
+	}
+	for _, s := range other.Sources {
+		if sources[s.Id] {
+			return fmt.Errorf("duplicate source id %q", s.Id)
+		}
+	}
+	graphs := map[string]bool{}
+	for _, g := range c.Graphs {
+		graphs[g.Id] = true
+	}
+	for _, g := range other.Graphs {
+		if graphs[g.Id] {
+			return fmt.Errorf("duplicate graph id %q", g.Id)
+		}
+	}
+
+	if other.DefaultTimeout != 0 {
+		c.DefaultTimeout = other.DefaultTimeout
+	}
+	if other.RefreshPeriod != 0 {
+		c.RefreshPeriod = other.RefreshPeriod
+	}
+	if other.Jitter != 0 {
+		c.Jitter = other.Jitter
+	}
+	if other.Pushgateway.URL != "" {
+		c.Pushgateway = other.Pushgateway
+	}
+	if other.Textfile.Path != "" {
+		c.Textfile = other.Textfile
+	}
+	if other.Exporter != "" {
+		c.Exporter = other.Exporter
+	}
+	if other.OTLP.Endpoint != "" {
+		c.OTLP = other.OTLP
+	}
+	if other.MaxCardinality != 0 {
+		c.MaxCardinality = other.MaxCardinality
+	}
+	if other.MetricsPath != "" {
+		c.MetricsPath = other.MetricsPath
+	}
+	if other.UI.Title != "" {
+		c.UI.Title = other.UI.Title
+	}
+	if other.UI.Logo != "" {
+		c.UI.Logo = other.UI.Logo
+	}
+	if other.UI.Footer != "" {
+		c.UI.Footer = other.UI.Footer
+	}
+	c.Monitors = append(c.Monitors, other.Monitors...)
+	c.Sources = append(c.Sources, other.Sources...)
+	c.Graphs = append(c.Graphs, other.Graphs...)
+	return nil
+}
+
+// merge appends the list values of other and overrides the rest.
+func (d dict) merge(other dict) {
+	for k, v := range other {
+		if list, ok := v.([]interface{}); ok {
+			if prev, ok := d[k].([]interface{}); ok {
+				d[k] = append(prev, list...)
+				continue
 			}
 		}
+		d[k] = v
 	}
-	return appConfig, err
 }
@@ -1,8 +1,14 @@
 package app
 
 import (
+	"errors"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,11 +23,11 @@ var testConfig = AppConfig{
 			Title: "Downstream Frequency",
 			Type:  "gauge",
 			Value: MonitorValueConfig{
-				"arris",
-				"downstream",
-				"power",
-				"%f dBmV",
-				[]MonitorValueLabelConfig{
+				SourceId: "arris",
+				RecordId: "downstream",
+				Header:   "power",
+				Format:   "%f dBmV",
+				Labels: []MonitorValueLabelConfig{
 					{Header: "dcid"}, {Header: "name"},
 				},
 			},
@@ -31,11 +37,11 @@ var testConfig = AppConfig{
 			Title: "Downstream SNR",
 			Type:  "gauge",
 			Value: MonitorValueConfig{
-				"arris",
-				"downstream",
-				"snr",
-				"%f dB",
-				[]MonitorValueLabelConfig{
+				SourceId: "arris",
+				RecordId: "downstream",
+				Header:   "snr",
+				Format:   "%f dB",
+				Labels: []MonitorValueLabelConfig{
 					{Header: "dcid"}, {Header: "name"},
 				},
 			},
@@ -142,3 +148,569 @@ func Test_LoadConfig(t *testing.T) {
 	assert.Error(t, err)
 
 }
+
+func Test_AppConfig_Validate(t *testing.T) {
+	assert.NoError(t, testConfig.Validate())
+
+	broken := AppConfig{
+		Monitors: []MonitorConfig{
+			{Id: "m1", Value: MonitorValueConfig{SourceId: "s1", RecordId: "r1"}},
+			{Id: "m1", Value: MonitorValueConfig{SourceId: "s1", RecordId: "r2"}},
+			{Id: "m2", Value: MonitorValueConfig{SourceId: "s2", RecordId: "r1"}},
+		},
+		Sources: []SourceConfig{
+			{Id: "s1", Output: SourceOutputConfig{Records: []ParserRecordConfig{{Id: "r1"}, {Id: "r1"}}}},
+			{Id: "s1"},
+		},
+		Graphs: []GraphConfig{
+			{Id: "m1"}, {Id: "m1"},
+		},
+	}
+	err := broken.Validate()
+	assert.EqualError(t, err, `sources.0.output.records.1.id: duplicate record id "r1"; `+
+		`sources.1.id: duplicate source id "s1"; `+
+		`monitors.1.id: duplicate monitor id "m1"; `+
+		`monitors.1.value.recordId: unknown record id "r2" in source "s1"; `+
+		`monitors.2.value.sourceId: unknown source id "s2"; `+
+		`graphs.1.id: duplicate graph id "m1"`)
+	assert.Len(t, err, 6)
+}
+
+func Test_AppConfig_Validate_otlp(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		wantErr  string
+	}{
+		{"", ""},
+		{"http://collector:4318", ""},
+		{"https://collector/v1/metrics", ""},
+		{"collector:4318", `otlp.endpoint: must be an http or https URL, got "collector:4318"`},
+		{"grpc://collector:4317", `otlp.endpoint: must be an http or https URL, got "grpc://collector:4317"`},
+	}
+	for _, tt := range tests {
+		config := AppConfig{Exporter: "otlp", OTLP: OTLPConfig{Endpoint: tt.endpoint}}
+		err := config.Validate()
+		if tt.wantErr == "" {
+			assert.NoError(t, err, tt.endpoint)
+		} else {
+			assert.EqualError(t, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_AppConfig_Validate_dependsOn(t *testing.T) {
+	config := AppConfig{
+		Sources: []SourceConfig{
+			{Id: "s1", Output: SourceOutputConfig{Records: []ParserRecordConfig{{Id: "r1"}}}},
+			{Id: "s2", Command: "echo {{.name}}", DependsOn: SourceDependency{SourceId: "s1", RecordId: "r1"}},
+			{Id: "s3", Command: "echo {{.name", DependsOn: SourceDependency{SourceId: "s1", RecordId: "r2"}},
+			{Id: "s4", DependsOn: SourceDependency{SourceId: "s5"}},
+			{Id: "s5", DependsOn: SourceDependency{SourceId: "s4"}},
+			{Id: "s6", DependsOn: SourceDependency{SourceId: "s0"}},
+		},
+	}
+	err := config.Validate()
+	assert.EqualError(t, err, `sources.2.dependsOn.recordId: unknown record id "r2" in source "s1"; `+
+		`sources.2.command: template: s3:1: unclosed action; `+
+		`sources.3.dependsOn.recordId: unknown record id "" in source "s5"; `+
+		`sources.4.dependsOn.recordId: unknown record id "" in source "s4"; `+
+		`sources.5.dependsOn.sourceId: unknown source id "s0"; `+
+		`sources.3.dependsOn.sourceId: dependency cycle on source "s4"; `+
+		`sources.4.dependsOn.sourceId: dependency cycle on source "s5"`)
+}
+
+func Test_AppConfig_Validate_commands(t *testing.T) {
+	config := AppConfig{
+		Sources: []SourceConfig{
+			{Id: "s1", Commands: []string{"curl -s http://router/?page=1", "curl -s http://router/?page=2"}},
+			{Id: "s2", Command: "echo", Commands: []string{"echo"}},
+		},
+	}
+	assert.EqualError(t, config.Validate(), "sources.1.commands: conflicts with command")
+}
+
+func Test_AppConfig_Validate_headerPattern(t *testing.T) {
+	config := AppConfig{
+		Sources: []SourceConfig{
+			{Id: "s1", Output: SourceOutputConfig{Records: []ParserRecordConfig{
+				{Id: "r1", FirstLineIsHeader: true, HeaderPattern: "^queue_"},
+				{Id: "r2", HeaderPattern: "^queue_"},
+				{Id: "r3", FirstLineIsHeader: true, HeaderPattern: "("},
+			}}},
+		},
+	}
+	assert.EqualError(t, config.Validate(), "sources.0.output.records.1.headerPattern: requires firstLineIsHeader; "+
+		"sources.0.output.records.2.headerPattern: error parsing regexp: missing closing ): `(`")
+}
+
+func Test_AppConfig_Validate_strictHeader(t *testing.T) {
+	config := AppConfig{
+		Sources: []SourceConfig{
+			{Id: "s1", Output: SourceOutputConfig{Records: []ParserRecordConfig{
+				{Id: "r1", FirstLineIsHeader: true, Header: []string{"a"}, StrictHeader: true},
+				{Id: "r2", Header: []string{"a"}, StrictHeader: true},
+				{Id: "r3", FirstLineIsHeader: true, StrictHeader: true},
+			}}},
+		},
+	}
+	assert.EqualError(t, config.Validate(), "sources.0.output.records.1.strictHeader: requires firstLineIsHeader and header; "+
+		"sources.0.output.records.2.strictHeader: requires firstLineIsHeader and header")
+}
+
+func Test_AppConfig_Validate_htmlqueryPath(t *testing.T) {
+	record := func(id string, options map[string]string) ParserRecordConfig {
+		return ParserRecordConfig{Id: id, ParserOptions: options}
+	}
+	config := AppConfig{
+		Sources: []SourceConfig{
+			{Id: "arris", Output: SourceOutputConfig{Parser: "htmlquery", Records: []ParserRecordConfig{
+				record("downstream", map[string]string{"format": "table", "path": "//table[2]/tbody"}),
+				record("upstream", map[string]string{"format": "table", "path": "//table[2/tbody"}),
+				record("channels", map[string]string{"format": "list", "path": "//div", "fields": "b, @data-freq, span[("}),
+				record("cells", map[string]string{"format": "css", "path": "table >"}),
+			}}},
+			{Id: "network", Output: SourceOutputConfig{Parser: "csv", Records: []ParserRecordConfig{
+				record("wifi", map[string]string{"path": "//table[2/tbody"}),
+			}}},
+		},
+	}
+	err := config.Validate()
+	assert.Error(t, err)
+	problems := err.(ConfigErrors)
+	assert.Len(t, problems, 3)
+	assert.Contains(t, problems[0].Error(), `sources.0.output.records.1.parserOptions: record "upstream": invalid XPath 'path' "//table[2/tbody"`)
+	assert.Contains(t, problems[1].Error(), `sources.0.output.records.2.parserOptions: record "channels": invalid XPath 'fields' "span[("`)
+	assert.Contains(t, problems[2].Error(), `sources.0.output.records.3.parserOptions: record "cells": invalid CSS selector 'path' "table >"`)
+}
+
+func Test_AppConfig_Validate_encoding(t *testing.T) {
+	config := AppConfig{
+		Sources: []SourceConfig{
+			{Id: "s1", Encoding: "iso-8859-1"},
+			{Id: "s2", Encoding: "windows-1252"},
+			{Id: "s3", Encoding: "latin-42"},
+		},
+	}
+	assert.EqualError(t, config.Validate(), `sources.2.encoding: unknown encoding "latin-42"`)
+}
+
+func Test_AppConfig_Validate_sourcePlugins(t *testing.T) {
+	config := AppConfig{
+		Sources: []SourceConfig{
+			{Id: "s1", Type: "shell", Output: SourceOutputConfig{Parser: "csv"}},
+			{Id: "s2", Type: "shel", Output: SourceOutputConfig{Parser: "cvs"}},
+			{Id: "s3", Type: "snmp", Output: SourceOutputConfig{Parser: "xml"}},
+			{Id: "s4", Output: SourceOutputConfig{Stages: []OutputStageConfig{{Parser: "htmlqeury"}}}},
+		},
+	}
+	assert.EqualError(t, config.Validate(), strings.Join([]string{
+		`sources.1.output.parser: unknown parser "cvs" (did you mean "csv"?)`,
+		`sources.1.type: unknown source type "shel" (did you mean "shell"?)`,
+		`sources.2.output.parser: unknown parser "xml"`,
+		`sources.2.type: unknown source type "snmp"`,
+		`sources.3.output.stages.0.parser: unknown parser "htmlqeury" (did you mean "htmlquery"?)`,
+	}, "; "))
+}
+
+func Test_AppConfig_Validate_monitorType(t *testing.T) {
+	config := AppConfig{
+		Sources: []SourceConfig{
+			{Id: "s1", Output: SourceOutputConfig{Records: []ParserRecordConfig{{Id: "r1"}}}},
+		},
+		Monitors: []MonitorConfig{
+			{Id: "m1", Value: MonitorValueConfig{SourceId: "s1", RecordId: "r1"}},
+			{Id: "m2", Type: "gauge", Value: MonitorValueConfig{SourceId: "s1", RecordId: "r1"}},
+			{Id: "m3", Type: "guage", Value: MonitorValueConfig{SourceId: "s1", RecordId: "r1"}},
+			{Id: "m4", Type: "histogram", Value: MonitorValueConfig{SourceId: "s1", RecordId: "r1"}},
+		},
+	}
+	assert.EqualError(t, config.Validate(), `monitors.2.type: unknown monitor type "guage" (did you mean "gauge"?); `+
+		`monitors.3.type: unknown monitor type "histogram"`)
+}
+
+func Test_AppConfig_Validate_addSourceLabel(t *testing.T) {
+	config := AppConfig{
+		Sources: []SourceConfig{
+			{Id: "s1", Output: SourceOutputConfig{Records: []ParserRecordConfig{{Id: "r1"}}}},
+		},
+		Monitors: []MonitorConfig{
+			{Id: "m1", AddSourceLabel: true, Value: MonitorValueConfig{SourceId: "s1", RecordId: "r1", Labels: []MonitorValueLabelConfig{{Header: "name"}}}},
+			{Id: "m2", AddSourceLabel: true, Value: MonitorValueConfig{SourceId: "s1", RecordId: "r1", Labels: []MonitorValueLabelConfig{{Header: "source"}}}},
+			{Id: "m3", Value: MonitorValueConfig{SourceId: "s1", RecordId: "r1", Labels: []MonitorValueLabelConfig{{Header: "source"}}}},
+		},
+	}
+	assert.EqualError(t, config.Validate(), "monitors.1.value.labels.0.header: conflicts with addSourceLabel")
+}
+
+func Test_LoadConfig_timeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout string
+		want    time.Duration
+		wantErr string
+	}{
+		{"seconds", `"5s"`, 5 * time.Second, ""},
+		{"milliseconds", `500ms`, 500 * time.Millisecond, ""},
+		{"bad unit", `5x`, 0, "yaml: unmarshal errors:\n  line 6: cannot unmarshal !!str `5x` into time.Duration"},
+		{"bare integer", `5`, 0, "sources.0.timeout: Invalid type. Expected: string, given: integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config.yaml")
+			err := os.WriteFile(filename, []byte(`
+monitors: []
+sources:
+  - id: network
+    command: echo
+    timeout: `+tt.timeout+`
+`), 0644)
+			assert.NoError(t, err)
+
+			got, err := LoadConfig(filename)
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got.Sources[0].Timeout)
+			}
+		})
+	}
+}
+
+func Test_LoadConfig_valueMap(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(filename, []byte(`
+monitors:
+  - id: link
+    value:
+      sourceId: modem
+      recordId: status
+      header: link
+      valueMap: {locked: 1, unlocked: 0, true: 1, false: 0}
+sources:
+  - id: modem
+    command: echo
+`), 0644)
+	assert.NoError(t, err)
+
+	got, err := LoadConfig(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{
+		"locked": 1, "unlocked": 0, "true": 1, "false": 0,
+	}, got.Monitors[0].Value.ValueMap)
+}
+
+func Test_AppConfig_Save_mode(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "nested", "dir", "config.yaml")
+
+	err := testConfig.Save(filename)
+	assert.NoError(t, err)
+
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+}
+
+func Test_AppConfig_Save_durations(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	config := AppConfig{
+		DefaultTimeout: 5 * time.Second,
+		RefreshPeriod:  1500 * time.Millisecond,
+		Monitors:       []MonitorConfig{},
+		Sources: []SourceConfig{
+			{Id: "network", Command: "echo", Timeout: time.Second, Jitter: 250 * time.Millisecond},
+		},
+	}
+	assert.NoError(t, config.Save(filename))
+
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	for _, line := range []string{"defaultTimeout: 5s", "refreshPeriod: 1.5s", "timeout: 1s", "jitter: 250ms"} {
+		assert.Contains(t, string(data), line)
+	}
+
+	got, err := LoadConfig(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, config.DefaultTimeout, got.DefaultTimeout)
+	assert.Equal(t, config.RefreshPeriod, got.RefreshPeriod)
+	assert.Equal(t, config.Sources[0].Timeout, got.Sources[0].Timeout)
+	assert.Equal(t, config.Sources[0].Jitter, got.Sources[0].Jitter)
+}
+
+func Test_AppConfig_Save_invalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	config := AppConfig{
+		Monitors: []MonitorConfig{
+			{Id: "signal", Value: MonitorValueConfig{SourceId: "missing"}},
+		},
+	}
+
+	err := config.Save(filename)
+	assert.EqualError(t, err, `monitors.0.value.sourceId: unknown source id "missing"`)
+	assert.NoFileExists(t, filename)
+}
+
+func Test_ExampleConfig(t *testing.T) {
+	for _, parser := range []string{"csv", "htmlquery"} {
+		t.Run(parser, func(t *testing.T) {
+			data, err := ExampleConfig(parser)
+			assert.NoError(t, err)
+
+			filename := filepath.Join(t.TempDir(), "config.yaml")
+			assert.NoError(t, os.WriteFile(filename, data, 0644))
+
+			config, err := LoadConfig(filename)
+			assert.NoError(t, err)
+			assert.NoError(t, config.Validate())
+			assert.NotEmpty(t, config.Monitors)
+			assert.Equal(t, parser, config.Sources[0].Output.Parser)
+		})
+	}
+
+	_, err := ExampleConfig("xml")
+	assert.EqualError(t, err, `no example config for parser "xml"`)
+}
+
+func Test_LoadConfig_stdin(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = strings.NewReader("monitors: []\nsources: [{id: network, command: echo}]\n")
+
+	got, err := LoadConfig("-")
+	assert.NoError(t, err)
+	assert.Equal(t, "network", got.Sources[0].Id)
+
+	stdin = strings.NewReader("monitors: []\n")
+	_, err = LoadConfig("-")
+	assert.EqualError(t, err, "-: sources: required")
+}
+
+func Test_LoadConfig_url(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/config.yaml":
+			io.WriteString(w, "monitors: []\nsources: [{id: network, command: echo}]\n")
+		case "/invalid.yaml":
+			io.WriteString(w, "monitors: []\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	got, err := LoadConfig(ts.URL + "/config.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "network", got.Sources[0].Id)
+
+	_, err = LoadConfig(ts.URL + "/invalid.yaml")
+	assert.EqualError(t, err, ts.URL+"/invalid.yaml: sources: required")
+
+	_, err = LoadConfig(ts.URL + "/missing.yaml")
+	assert.EqualError(t, err, ts.URL+"/missing.yaml: unexpected status 404 Not Found")
+}
+
+func Test_LoadConfig_dir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"arris.yaml": `
+monitors:
+  - id: power
+    value: {sourceId: arris, recordId: downstream, header: power}
+sources:
+  - id: arris
+    command: cat arris.html
+    output: {parser: htmlquery, records: [{id: downstream}]}
+`,
+		"network.yml": `
+sources:
+  - id: network
+    command: nmcli
+    output: {parser: csv, records: [{id: wifi}]}
+monitors:
+  - id: signal
+    value: {sourceId: network, recordId: wifi, header: signal}
+`,
+		"README.txt": "not a config",
+	}
+	for name, data := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+
+	got, err := LoadConfig(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, got.Validate())
+	assert.Equal(t, []string{"power", "signal"}, []string{got.Monitors[0].Id, got.Monitors[1].Id})
+	assert.Equal(t, []string{"arris", "network"}, []string{got.Sources[0].Id, got.Sources[1].Id})
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "wifi.yaml"), []byte("sources: [{id: network}]\n"), 0644))
+	_, err = LoadConfig(dir)
+	assert.EqualError(t, err, dir+`: wifi.yaml: document 0: duplicate source id "network"`)
+
+	empty := t.TempDir()
+	_, err = LoadConfig(empty)
+	assert.EqualError(t, err, empty+": no config files")
+}
+
+func Test_LoadConfig_schemaErrors(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(filename, []byte(`
+monitors:
+  - id: signal_strength
+    value:
+      header: 1
+      unknown: true
+`), 0644)
+	assert.NoError(t, err)
+
+	_, err = LoadConfig(filename)
+	assert.EqualError(t, err, filename+": sources: required (and 2 more)")
+
+	var schemaErr *SchemaError
+	assert.True(t, errors.As(err, &schemaErr))
+	assert.Equal(t, filename, schemaErr.Filename)
+
+	var problems ConfigErrors
+	assert.True(t, errors.As(err, &problems))
+	assert.ElementsMatch(t, ConfigErrors{
+		&FieldError{"sources", "required"},
+		&FieldError{"monitors.0.value", "Additional property unknown is not allowed"},
+		&FieldError{"monitors.0.value.header", "Invalid type. Expected: string, given: integer"},
+	}, problems)
+}
+
+func Test_LoadConfigWithOptions_noValidate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(filename, []byte(`
+monitors:
+  - id: signal_strength
+    pilotField: true
+sources: []
+`), 0644)
+	assert.NoError(t, err)
+
+	_, err = LoadConfigWithOptions(filename, LoadConfigOptions{})
+	assert.EqualError(t, err, filename+": monitors.0: Additional property pilotField is not allowed")
+
+	got, err := LoadConfigWithOptions(filename, LoadConfigOptions{NoValidate: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []MonitorConfig{{Id: "signal_strength"}}, got.Monitors)
+}
+
+func Test_LoadConfig_multiDocument(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    AppConfig
+		wantErr string
+	}{
+		{
+			"merged",
+			`
+jitter: 1s
+monitors:
+  - id: power
+    value: {sourceId: arris, recordId: downstream, header: power}
+sources:
+  - id: arris
+    command: cat arris.html
+---
+defaultTimeout: 5s
+monitors:
+  - id: signal
+    value: {sourceId: network, recordId: wifi, header: signal}
+sources:
+  - id: network
+    command: nmcli
+graphs:
+  - id: signal
+`,
+			AppConfig{
+				DefaultTimeout: 5 * time.Second,
+				Jitter:         1 * time.Second,
+				Monitors: []MonitorConfig{
+					{Id: "power", Value: MonitorValueConfig{SourceId: "arris", RecordId: "downstream", Header: "power"}},
+					{Id: "signal", Value: MonitorValueConfig{SourceId: "network", RecordId: "wifi", Header: "signal"}},
+				},
+				Sources: []SourceConfig{
+					{Id: "arris", Command: "cat arris.html"},
+					{Id: "network", Command: "nmcli"},
+				},
+				Graphs: []GraphConfig{
+					{Id: "signal"},
+				},
+			},
+			"",
+		},
+		{
+			"duplicate id",
+			`
+monitors: []
+sources:
+  - id: arris
+---
+sources:
+  - id: arris
+`,
+			AppConfig{},
+			"document 1: duplicate source id \"arris\"",
+		},
+		{
+			"merged schema error",
+			`
+monitors: []
+---
+sources:
+  - id: arris
+    unknown: true
+`,
+			AppConfig{},
+			"sources.0: Additional property unknown is not allowed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config.yaml")
+			err := os.WriteFile(filename, []byte(tt.config), 0644)
+			assert.NoError(t, err)
+
+			got, err := LoadConfig(filename)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, filename+": "+tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_AppConfig_Validate_labelTemplate(t *testing.T) {
+	config := testConfig
+	config.Monitors = []MonitorConfig{testConfig.Monitors[0]}
+	config.Monitors[0].Value.Labels = []MonitorValueLabelConfig{
+		{Header: "channel", Template: "{{.dcid}}/{{.name"},
+	}
+	assert.EqualError(t, config.Validate(), "monitors.0.value.labels.0.template: template: channel:1: unclosed action")
+}
+
+func Test_AppConfig_Validate_stages(t *testing.T) {
+	config := AppConfig{
+		Sources: []SourceConfig{
+			{Id: "modem", Command: "true", Output: SourceOutputConfig{
+				Parser:  "csv",
+				Records: []ParserRecordConfig{{Id: "status"}},
+				Stages: []OutputStageConfig{
+					{Parser: "htmlquery", Records: []ParserRecordConfig{{Id: "downstream"}}},
+					{Parser: "xml", Records: []ParserRecordConfig{{Id: "status"}}},
+				},
+			}},
+		},
+		Monitors: []MonitorConfig{
+			{Id: "power", Value: MonitorValueConfig{SourceId: "modem", RecordId: "downstream"}},
+		},
+	}
+	assert.EqualError(t, config.Validate(), strings.Join([]string{
+		`sources.0.output.stages.1.parser: unknown parser "xml"`,
+		`sources.0.output.stages.1.records.0.id: duplicate record id "status"`,
+	}, "; "))
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SourceReport is the outcome of a source pulled once by Diagnose, with
+// the number of rows of each record.
+type SourceReport struct {
+	Id   string
+	Err  error
+	Rows map[string]int
+}
+
+// MonitorReport is what a monitor reads from a single pull, with hints
+// on why it reads no usable value.
+type MonitorReport struct {
+	Id      string
+	Rows    int
+	Values  int
+	NonZero int
+	Hints   []string
+}
+
+// Report is the outcome of Diagnose.
+type Report struct {
+	Sources  []SourceReport
+	Monitors []MonitorReport
+}
+
+// Problems returns the number of failed sources and monitors with hints.
+func (r Report) Problems() int {
+	n := 0
+	for _, s := range r.Sources {
+		if s.Err != nil {
+			n++
+		}
+	}
+	for _, m := range r.Monitors {
+		if len(m.Hints) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Diagnose pulls all sources once and checks that every monitor reads at
+// least one row with a non-zero value, hinting at the likely cause
+// otherwise. Nothing is pushed to the monitors.
+func (ws *WatchService) Diagnose(ctx context.Context) Report {
+	data := ws.pullSources(ctx, nil)
+	status := ws.SourcesStatus()
+
+	var report Report
+	for i, s := range ws.sources {
+		sr := SourceReport{Id: s.c.Id, Err: status[i].LastError, Rows: map[string]int{}}
+		if value, ok := data.Load(s.c.Id); ok {
+			for id, rr := range value.(records) {
+				sr.Rows[id] = len(rr)
+			}
+		} else if sr.Err == nil {
+			sr.Err = fmt.Errorf("not pulled, dependency %q failed", s.c.DependsOn.SourceId)
+		}
+		report.Sources = append(report.Sources, sr)
+	}
+
+	for _, m := range ws.monitors {
+		report.Monitors = append(report.Monitors, m.diagnose(data))
+	}
+	return report
+}
+
+func (m *Monitor) diagnose(data *sync.Map) MonitorReport {
+	c := m.c.Value
+	mr := MonitorReport{Id: m.c.Id}
+	hint := func(format string, args ...interface{}) {
+		mr.Hints = append(mr.Hints, fmt.Sprintf(format, args...))
+	}
+
+	value, ok := data.Load(c.SourceId)
+	if !ok {
+		hint("source %q failed, see its error", c.SourceId)
+		return mr
+	}
+	rr := value.(records)[c.RecordId]
+	mr.Rows = len(rr)
+	if len(rr) == 0 {
+		hint("record %q of source %q has no rows", c.RecordId, c.SourceId)
+		return mr
+	}
+
+	headers := map[string]bool{}
+	var sample string
+	for _, r := range rr {
+		for h := range r {
+			headers[h] = true
+		}
+		if v, ok := r.value(c); ok {
+			mr.Values++
+			if v.value != 0 {
+				mr.NonZero++
+			}
+		} else if s, found := r[c.Header]; found && sample == "" {
+			sample = s
+		}
+	}
+
+	switch {
+	case !headers[c.Header]:
+		hint("header %q not found in record %q (headers: %s)", c.Header, c.RecordId, headerList(headers))
+	case mr.Values == 0:
+		hint("no value of header %q matches format %q, e.g. %q", c.Header, c.Format, sample)
+	case mr.NonZero == 0:
+		hint("all values of header %q are zero", c.Header)
+	}
+	for _, l := range c.Labels {
+		if l.Template == "" && !headers[l.Header] {
+			hint("label header %q not found in record %q", l.Header, c.RecordId)
+		}
+	}
+	return mr
+}
+
+// headerList returns the sorted header names, quoted.
+func headerList(headers map[string]bool) string {
+	names := make([]string, 0, len(headers))
+	for h := range headers {
+		names = append(names, fmt.Sprintf("%q", h))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
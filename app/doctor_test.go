@@ -0,0 +1,53 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WatchService_Diagnose(t *testing.T) {
+	csv := func(id, command string, header ...string) SourceConfig {
+		return SourceConfig{Id: id, Command: command, Output: SourceOutputConfig{
+			Parser:  "csv",
+			Records: []ParserRecordConfig{{Id: "r", Header: header}},
+		}}
+	}
+	monitor := func(id, sourceId, header string, labels ...MonitorValueLabelConfig) MonitorConfig {
+		return MonitorConfig{Id: id, Value: MonitorValueConfig{SourceId: sourceId, RecordId: "r", Header: header, Labels: labels}}
+	}
+	ws := NewWatchService(AppConfig{
+		Monitors: []MonitorConfig{
+			monitor("ok", "ok", "v"),
+			monitor("failing", "failing", "v"),
+			monitor("empty", "empty", "v"),
+			monitor("unparsed", "unparsed", "v"),
+			monitor("zero", "zero", "v", MonitorValueLabelConfig{Header: "name"}),
+		},
+		Sources: []SourceConfig{
+			csv("ok", "echo 42", "v"),
+			csv("failing", "exit 1", "v"),
+			csv("empty", "true", "v"),
+			csv("unparsed", "echo n/a", "v"),
+			csv("zero", "echo 0", "v"),
+		},
+	})
+
+	report := ws.Diagnose(context.Background())
+	assert.Equal(t, 5, report.Problems())
+	if assert.Len(t, report.Sources, 5) {
+		assert.Equal(t, SourceReport{Id: "ok", Rows: map[string]int{"r": 1}}, report.Sources[0])
+		assert.EqualError(t, report.Sources[1].Err, "exit status 1")
+	}
+	assert.Equal(t, []MonitorReport{
+		{Id: "ok", Rows: 1, Values: 1, NonZero: 1},
+		{Id: "failing", Hints: []string{`source "failing" failed, see its error`}},
+		{Id: "empty", Hints: []string{`record "r" of source "empty" has no rows`}},
+		{Id: "unparsed", Rows: 1, Hints: []string{`no value of header "v" matches format "%f", e.g. "n/a"`}},
+		{Id: "zero", Rows: 1, Values: 1, Hints: []string{
+			`all values of header "v" are zero`,
+			`label header "name" not found in record "r"`,
+		}},
+	}, report.Monitors)
+}
@@ -0,0 +1,90 @@
+//go:build !windows
+
+package app
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup starts the command in its own process group, so the
+// processes it spawns can be killed along with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the command and every process of its group.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// setCredential makes the command run as the source runAsUser and
+// runAsGroup, given by name or id. The group defaults to the user primary
+// group.
+func setCredential(cmd *exec.Cmd, s *Source) error {
+	if s.c.RunAsUser == "" && s.c.RunAsGroup == "" {
+		return nil
+	}
+	cred := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if s.c.RunAsUser != "" {
+		uid, gid, err := lookupUser(s.c.RunAsUser)
+		if err != nil {
+			return err
+		}
+		cred.Uid, cred.Gid = uid, gid
+	}
+	if s.c.RunAsGroup != "" {
+		gid, err := lookupGroup(s.c.RunAsGroup)
+		if err != nil {
+			return err
+		}
+		cred.Gid = gid
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = cred
+	return nil
+}
+
+// lookupUser returns the uid and primary gid of a user name or id.
+func lookupUser(name string) (uid, gid uint32, err error) {
+	u, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		u, err = user.LookupId(name)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("unknown user %q", name)
+	}
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %q: invalid uid %q", name, u.Uid)
+	}
+	group, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %q: invalid gid %q", name, u.Gid)
+	}
+	return uint32(id), uint32(group), nil
+}
+
+// lookupGroup returns the gid of a group name or id.
+func lookupGroup(name string) (uint32, error) {
+	g, err := user.LookupGroup(name)
+	if _, ok := err.(user.UnknownGroupError); ok {
+		g, err = user.LookupGroupId(name)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %q", name)
+	}
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("group %q: invalid gid %q", name, g.Gid)
+	}
+	return uint32(id), nil
+}
@@ -0,0 +1,65 @@
+//go:build !windows
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_setCredential(t *testing.T) {
+	cmd := exec.Command("true")
+	setProcessGroup(cmd)
+	assert.NoError(t, setCredential(cmd, &Source{}))
+	assert.Nil(t, cmd.SysProcAttr.Credential)
+
+	s := &Source{c: SourceConfig{RunAsUser: "root", RunAsGroup: "0"}}
+	assert.NoError(t, setCredential(cmd, s))
+	assert.True(t, cmd.SysProcAttr.Setpgid)
+	assert.Equal(t, &syscall.Credential{Uid: 0, Gid: 0}, cmd.SysProcAttr.Credential)
+
+	s = &Source{c: SourceConfig{RunAsGroup: "0"}}
+	assert.NoError(t, setCredential(cmd, s))
+	assert.Equal(t, &syscall.Credential{Uid: uint32(os.Getuid()), Gid: 0}, cmd.SysProcAttr.Credential)
+
+	s = &Source{c: SourceConfig{RunAsUser: "watchmon-nonexistent"}}
+	assert.EqualError(t, setCredential(cmd, s), `unknown user "watchmon-nonexistent"`)
+}
+
+func Test_shellCommand_Execute_runAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("switching user requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+
+	s := &Source{c: SourceConfig{Command: "id -u", Timeout: 5 * time.Second, RunAsUser: "nobody"}}
+	got, err := (&shellCommand{}).Execute(context.Background(), s)
+	assert.NoError(t, err)
+	assert.Equal(t, nobody.Uid, strings.TrimSpace(string(got)))
+}
+
+func Test_AppConfig_Validate_runAs(t *testing.T) {
+	config := testConfig
+	config.Sources = append([]SourceConfig(nil), testConfig.Sources...)
+	config.Sources[0].RunAsUser = "root"
+	config.Sources[0].RunAsGroup = "0"
+	assert.NoError(t, config.Validate())
+
+	config.Sources[0].RunAsUser = "watchmon-nonexistent"
+	config.Sources[0].RunAsGroup = "watchmon-nonexistent"
+	assert.EqualError(t, config.Validate(), fmt.Sprintf("%s; %s",
+		`sources.0.runAsUser: unknown user "watchmon-nonexistent"`,
+		`sources.0.runAsGroup: unknown group "watchmon-nonexistent"`))
+}
@@ -0,0 +1,34 @@
+package app
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the command, processes it spawned keep running.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// setCredential fails for a source with runAsUser or runAsGroup, not
+// supported on windows.
+func setCredential(cmd *exec.Cmd, s *Source) error {
+	if s.c.RunAsUser != "" || s.c.RunAsGroup != "" {
+		return errNoCredential
+	}
+	return nil
+}
+
+var errNoCredential = errors.New("runAsUser and runAsGroup are not supported on windows")
+
+func lookupUser(name string) (uid, gid uint32, err error) {
+	return 0, 0, errNoCredential
+}
+
+func lookupGroup(name string) (uint32, error) {
+	return 0, errNoCredential
+}
@@ -0,0 +1,11 @@
+package app
+
+// UnregisterPlugins removes the parser, command and metric registered by
+// the tests under name.
+func UnregisterPlugins(name string) {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	delete(plugins.parsers, name)
+	delete(plugins.commands, name)
+	delete(plugins.metrics, name)
+}
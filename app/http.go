@@ -1,13 +1,22 @@
 package app
 
 import (
+	"bytes"
 	"embed"
 	"encoding/json"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"strings"
 	"text/template"
+	"time"
 
+	prom "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/realitycheck/watchmon/pkg/yamlutil"
+	log "github.com/sirupsen/logrus"
 )
 
 //go:embed templates static
@@ -24,23 +33,128 @@ type HTTPService struct {
 	mux *http.ServeMux
 
 	configData dict
+	configYAML []byte
+
+	// metricsAddr is where the metrics are served when not by the service
+	metricsAddr string
+	metricsPath string
 
 	templatesData map[string]dict
+
+	sourcesStatus func() []SourceStatus
+
+	subscribeLive func() (<-chan []byte, func())
 }
 
-func NewHTTPService(config AppConfig) *HTTPService {
-	hs := &HTTPService{mux: http.NewServeMux()}
+// NewHTTPService creates the dashboard service, the metrics are served
+// from gatherer at the config metrics path unless it is nil.
+func NewHTTPService(config AppConfig, gatherer prom.Gatherer) *HTTPService {
+	hs := &HTTPService{mux: http.NewServeMux(), metricsPath: config.metricsPath()}
 
 	hs.configData = makeConfigData(config)
 	hs.templatesData = makeTemplatesData(config)
 
 	hs.mux.Handle("/", http.HandlerFunc(hs.serveRoot))
 	hs.mux.Handle("/config.json", http.HandlerFunc(hs.serveConfigData))
-	hs.mux.Handle("/metrics", promhttp.Handler())
+	if gatherer != nil {
+		hs.mux.Handle(config.metricsPath(), NewMetricsHandlerAt(gatherer, config.metricsPath()))
+	}
 	hs.mux.Handle("/static/", http.FileServer(http.FS(content)))
 	return hs
 }
 
+// NewMetricsHandler creates a standalone /metrics handler for gatherer.
+func NewMetricsHandler(gatherer prom.Gatherer) http.Handler {
+	return NewMetricsHandlerAt(gatherer, DefaultMetricsPath)
+}
+
+// NewMetricsHandlerAt creates a standalone handler serving the metrics of
+// gatherer at path.
+func NewMetricsHandlerAt(gatherer prom.Gatherer, path string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	}))
+	return mux
+}
+
+// NewCORSHandler serves h with the CORS headers letting the pages of the
+// origins allowed read its responses, e.g. a dashboard polling metrics
+// served apart.
+func NewCORSHandler(h http.Handler, allowed func(origin string) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && allowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// NewProfilingHandler serves the pprof endpoints at /debug/pprof/ and
+// the other requests with h.
+func NewProfilingHandler(h http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", h)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// NewLoggingHandler logs every request served by h with its status and
+// latency.
+func NewLoggingHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		httpLog("access").WithFields(log.Fields{
+			"method":  r.Method,
+			"path":    r.URL.Path,
+			"status":  sw.status,
+			"latency": time.Since(start),
+		}).Info("Request served")
+	})
+}
+
+// statusWriter records the status code written to the ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// HandleConfigYAML serves the config in effect, resolved and with its
+// credentials redacted, as YAML at /config.yaml behind guard.
+func (hs *HTTPService) HandleConfigYAML(config AppConfig, guard func(http.HandlerFunc) http.HandlerFunc) error {
+	data, err := yamlutil.Marshal(config.Resolved().Redacted())
+	if err != nil {
+		return err
+	}
+	hs.configYAML = data
+	hs.mux.Handle("/config.yaml", guard(hs.serveConfigYAML))
+	return nil
+}
+
+// HandleSources serves the sources status at /sources.
+func (hs *HTTPService) HandleSources(status func() []SourceStatus) {
+	hs.sourcesStatus = status
+	hs.mux.Handle("/sources", http.HandlerFunc(hs.serveSources))
+}
+
+// HandleLive serves at /ws a websocket pushing the frames of subscribe.
+func (hs *HTTPService) HandleLive(subscribe func() (<-chan []byte, func())) {
+	hs.subscribeLive = subscribe
+	hs.mux.Handle("/ws", http.HandlerFunc(hs.serveLive))
+}
+
 func (hs *HTTPService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	hs.mux.ServeHTTP(w, r)
 }
@@ -52,22 +166,143 @@ func (hs *HTTPService) serveRoot(w http.ResponseWriter, r *http.Request) {
 	}
 	tmpl := templates.Lookup(res + ".tmpl")
 	if tmpl == nil {
-		http.NotFound(w, r)
+		httpError(w, r, "404 page not found", http.StatusNotFound)
 		return
 	}
-	if err := tmpl.Execute(w, hs.templatesData[res]); err != nil {
+	// rendered first so a failure is replied as an error
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, hs.templatesData[res]); err != nil {
 		httpLog("index.html").WithError(err).Error("can't execute template")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	buf.WriteTo(w)
+}
+
+// SetMetricsAddr makes the dashboard poll the metrics served at addr, by
+// a server apart from the service. An addr without host, or with the
+// unspecified address, is taken on the host the dashboard is requested at.
+func (hs *HTTPService) SetMetricsAddr(addr string) {
+	hs.metricsAddr = addr
+}
+
+// metricsURL returns the URL the dashboard requested by r polls the
+// metrics at.
+func (hs *HTTPService) metricsURL(r *http.Request) string {
+	if hs.metricsAddr == "" {
+		return hs.metricsPath
+	}
+	host, port, err := net.SplitHostPort(hs.metricsAddr)
+	if err != nil {
+		return hs.metricsPath
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+	}
+	return "http://" + net.JoinHostPort(host, port) + hs.metricsPath
 }
 
 func (hs *HTTPService) serveConfigData(w http.ResponseWriter, r *http.Request) {
-	e := json.NewEncoder(w)
+	data := hs.configData
+	if hs.metricsAddr != "" {
+		data = make(dict, len(hs.configData))
+		for k, v := range hs.configData {
+			data[k] = v
+		}
+		data["url"] = hs.metricsURL(r)
+	}
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
 	e.SetIndent("", "  ")
-	if err := e.Encode(hs.configData); err != nil {
+	if err := e.Encode(data); err != nil {
 		httpLog("config.json").WithError(err).Error("can't encode data")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	buf.WriteTo(w)
+}
+
+// httpError replies the error message as a JSON {"error": msg} object to
+// the clients accepting application/json, as plain text otherwise.
+func httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if !acceptsJSON(r) {
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(dict{"error": msg}); err != nil {
+		httpLog("error").WithError(err).Error("can't encode error")
+	}
+}
+
+// acceptsJSON tells whether the request Accept header lists
+// application/json.
+func acceptsJSON(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, t := range strings.Split(v, ",") {
+			mt, _, err := mime.ParseMediaType(strings.TrimSpace(t))
+			if err == nil && mt == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (hs *HTTPService) serveConfigYAML(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		httpError(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(hs.configYAML)
+}
+
+func (hs *HTTPService) serveSources(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		httpError(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := hs.sourcesStatus()
+	data := make([]dict, len(status))
+	for i, s := range status {
+		d := dict{
+			"id":            s.Id,
+			"command":       s.Command,
+			"parser":        s.Parser,
+			"lastPull":      nil,
+			"lastDuration":  s.LastDuration.Seconds(),
+			"lastError":     nil,
+			"parseWarnings": map[string]int{},
+		}
+		if s.ParseWarnings != nil {
+			d["parseWarnings"] = s.ParseWarnings
+		}
+		if !s.LastPull.IsZero() {
+			d["lastPull"] = s.LastPull.UTC().Format(time.RFC3339Nano)
+		}
+		if s.LastError != nil {
+			d["lastError"] = s.LastError.Error()
+		}
+		data[i] = d
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(data); err != nil {
+		httpLog("sources").WithError(err).Error("can't encode data")
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
@@ -88,8 +323,36 @@ func makeTemplatesData(config AppConfig) map[string]dict {
 		return i
 	}
 
+	// monitors of a multi-monitor graph share one canvas in place of
+	// the first of them
+	shared := map[string]*MonitorConfig{}
+	monitors := config.MonitorsMap()
+	for _, g := range config.Graphs {
+		if len(g.Monitors) == 0 {
+			continue
+		}
+		canvas := &MonitorConfig{Id: g.Id}
+		var titles []string
+		for _, id := range g.Monitors {
+			if m, ok := monitors[id]; ok {
+				titles = append(titles, m.Title)
+			}
+			if _, ok := shared[id]; !ok {
+				shared[id] = nil
+			}
+		}
+		canvas.Title = strings.Join(titles, ", ")
+		shared[g.Monitors[0]] = canvas
+	}
+
 	data := map[int]*Group{}
 	for _, m := range config.Monitors {
+		if canvas, ok := shared[m.Id]; ok {
+			if canvas == nil {
+				continue
+			}
+			m.Id, m.Title = canvas.Id, canvas.Title
+		}
 		groupId := getGroupId(m.Value.SourceId + " " + m.Value.RecordId)
 		var group *Group
 		group, ok := data[groupId]
@@ -110,31 +373,117 @@ func makeTemplatesData(config AppConfig) map[string]dict {
 
 	return map[string]dict{
 		"index.html": {
-			"Canvas": canvas,
+			"Canvas":      canvas,
+			"UI":          makeUIConfig(config),
+			"MetricsPath": strings.TrimPrefix(config.metricsPath(), "/"),
 		},
 	}
 }
 
+// makeUIConfig returns the config UI block with defaults applied.
+func makeUIConfig(config AppConfig) UIConfig {
+	ui := config.UI
+	if ui.Title == "" {
+		ui.Title = DefaultUITitle
+	}
+	return ui
+}
+
+// chartOptions returns the graph chartOptions with the typed y axis
+// fields mapped to the chart keys, over the raw ones. With logScale the
+// chart draws log10 values, so are the bounds.
+func chartOptions(g GraphConfig) dict {
+	res := dict{}
+	for k, v := range g.ChartOptions {
+		res[k] = v
+	}
+	bound := func(v float64) float64 {
+		if g.LogScale {
+			return math.Log10(v)
+		}
+		return v
+	}
+	if g.YMin != nil {
+		res["minValue"] = bound(*g.YMin)
+	}
+	if g.YMax != nil {
+		res["maxValue"] = bound(*g.YMax)
+	}
+	if g.LogScale {
+		res["logScale"] = true
+	}
+	if g.Stacked {
+		res["stacked"] = true
+	}
+	return res
+}
+
 func makeConfigData(config AppConfig) dict {
-	graphs := make(dict, len(config.Graphs))
+	graphsConfig := config.Graphs
+	if len(graphsConfig) == 0 {
+		// one graph with default options per monitor
+		graphsConfig = make([]GraphConfig, len(config.Monitors))
+		for i, m := range config.Monitors {
+			graphsConfig[i] = GraphConfig{Id: m.Id}
+		}
+	}
+
+	graphs := make(dict, len(graphsConfig))
 	monitors := config.MonitorsMap()
-	for _, g := range config.Graphs {
+	for _, g := range graphsConfig {
+		var titles, metricNames []string
+		for _, id := range g.monitorIds() {
+			title, metricName := id, id
+			if m, ok := monitors[id]; ok {
+				title, metricName = m.Title, m.metricName()
+			}
+			titles = append(titles, title)
+			metricNames = append(metricNames, metricName)
+		}
+		if g.ChartDelay == 0 {
+			g.ChartDelay = DefaultChartDelay
+		}
+		g.ChartOptions = chartOptions(g)
+		if g.SeriesOptions == nil {
+			g.SeriesOptions = map[string]dict{}
+		}
+		// the retention is set along with the per series patterns
+		timeOptions := dict{
+			"retentionSeconds": g.RetentionSeconds,
+			"maxPoints":        g.MaxPoints,
+		}
+		for pattern, options := range g.TimeOptions {
+			timeOptions[pattern] = options
+		}
+		if g.Palette == nil {
+			g.Palette = []string{}
+		}
 		graphs[g.Id] = dict{
+			"metricName":    metricNames[0],
+			"metricNames":   metricNames,
 			"chartCanvas":   "#" + g.Id,
 			"chartDelay":    g.ChartDelay,
 			"chartOptions":  g.ChartOptions,
 			"seriesOptions": g.SeriesOptions,
-			"timeOptions":   g.TimeOptions,
+			"timeOptions":   timeOptions,
+			"maxSeries":     g.MaxSeries,
+			"palette":       g.Palette,
 			"legendOptions": dict{
 				"selector": "#" + g.Id + "_legend",
-				"title":    monitors[g.Id].Title,
+				"title":    strings.Join(titles, ", "),
 			},
 		}
 	}
+	ui := makeUIConfig(config)
 	return dict{
-		"url":     "/metrics",
+		"url":     config.metricsPath(),
 		"timeout": 1000,
 		"graphs":  graphs,
+		"ui": dict{
+			"title":  ui.Title,
+			"logo":   ui.Logo,
+			"footer": ui.Footer,
+		},
 		"controls": dict{
 			"startButton": "#start_btn",
 			"resetButton": "#reset_btn",
@@ -0,0 +1,208 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// liveBuffer is the number of frames queued for a live client, the
+	// frames of a client that falls further behind are dropped.
+	liveBuffer = 16
+
+	livePingPeriod   = 30 * time.Second
+	livePongWait     = 2 * livePingPeriod
+	liveWriteTimeout = 10 * time.Second
+)
+
+// liveFrame is the JSON frame sent to the live clients after a push cycle.
+type liveFrame struct {
+	Time    time.Time               `json:"time"`
+	Metrics map[string][]liveSample `json:"metrics"`
+}
+
+type liveSample struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// liveHub fans out the push cycle frames to the live clients.
+type liveHub struct {
+	mu      sync.Mutex
+	clients map[chan []byte]bool
+	closed  bool
+}
+
+func newLiveHub() *liveHub {
+	return &liveHub{clients: map[chan []byte]bool{}}
+}
+
+// subscribe registers a client, its channel is closed when unsubscribed
+// or when the hub is closed.
+func (h *liveHub) subscribe() (<-chan []byte, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan []byte, liveBuffer)
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	h.clients[ch] = true
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.clients[ch] {
+			delete(h.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// active tells whether any client is subscribed.
+func (h *liveHub) active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients) > 0
+}
+
+// broadcast queues frame to the clients without blocking.
+func (h *liveHub) broadcast(frame []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- frame:
+		default:
+			watchLog("live").Debug("Slow live client, frame dropped")
+		}
+	}
+}
+
+// close unsubscribes all clients.
+func (h *liveHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		delete(h.clients, ch)
+		close(ch)
+	}
+	h.closed = true
+}
+
+// Subscribe registers a live client receiving a JSON frame of the gathered
+// metrics after each push cycle. The returned func unsubscribes it.
+func (ws *WatchService) Subscribe() (<-chan []byte, func()) {
+	return ws.live.subscribe()
+}
+
+// broadcastLive sends the gathered metrics to the live clients, if any.
+func (ws *WatchService) broadcastLive() {
+	if !ws.live.active() {
+		return
+	}
+	frame, err := makeLiveFrame(ws.registry, time.Now())
+	if err != nil {
+		watchLog("live").WithError(err).Error("can't make live frame")
+		return
+	}
+	ws.live.broadcast(frame)
+}
+
+// makeLiveFrame encodes the gauge, counter and untyped metrics of gatherer.
+func makeLiveFrame(gatherer prom.Gatherer, t time.Time) ([]byte, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	frame := liveFrame{Time: t, Metrics: map[string][]liveSample{}}
+	for _, mf := range families {
+		samples := []liveSample{}
+		for _, m := range mf.GetMetric() {
+			s := liveSample{Labels: map[string]string{}}
+			for _, l := range m.GetLabel() {
+				s.Labels[l.GetName()] = l.GetValue()
+			}
+			switch {
+			case m.Gauge != nil:
+				s.Value = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				s.Value = m.GetCounter().GetValue()
+			case m.Untyped != nil:
+				s.Value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			samples = append(samples, s)
+		}
+		if len(samples) > 0 {
+			frame.Metrics[mf.GetName()] = samples
+		}
+	}
+	return json.Marshal(frame)
+}
+
+// liveUpgrader keeps the default origin check: only the pages of the
+// dashboard host can connect, other sites can't read the metrics through
+// the browser of the operator.
+var liveUpgrader = websocket.Upgrader{}
+
+// serveLive upgrades the request to a websocket and writes the live frames
+// to it, pinging the client to keep the connection alive.
+func (hs *HTTPService) serveLive(w http.ResponseWriter, r *http.Request) {
+	conn, err := liveUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has replied with the error
+		httpLog("ws").WithError(err).Debug("Websocket upgrade failure")
+		return
+	}
+	defer conn.Close()
+
+	frames, unsubscribe := hs.subscribeLive()
+	defer unsubscribe()
+
+	// read the client frames to handle the pongs and the close
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.SetReadDeadline(time.Now().Add(livePongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(livePongWait))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(livePingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case frame, ok := <-frames:
+			conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "watch service stopped"))
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				httpLog("ws").WithError(err).Debug("Websocket write failure")
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				httpLog("ws").WithError(err).Debug("Websocket ping failure")
+				return
+			}
+		}
+	}
+}
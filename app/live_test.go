@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HTTPService_HandleLive(t *testing.T) {
+	config := AppConfig{
+		Monitors: []MonitorConfig{
+			{
+				Id: "signal",
+				Value: MonitorValueConfig{
+					SourceId: "network",
+					RecordId: "wifi",
+					Header:   "signal",
+					Labels:   []MonitorValueLabelConfig{{Header: "ssid"}},
+				},
+			},
+		},
+		Sources: []SourceConfig{
+			{
+				Id:      "network",
+				Command: "echo 42:home",
+				Output: SourceOutputConfig{
+					Parser:  "csv",
+					Records: []ParserRecordConfig{{Id: "wifi", Header: []string{"signal", "ssid"}}},
+				},
+			},
+		},
+	}
+	ws := NewWatchService(config)
+	hs := NewHTTPService(config, ws.Gatherer())
+	hs.HandleLive(ws.Subscribe)
+	server := httptest.NewServer(hs)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Eventually(t, ws.live.active, time.Second, 10*time.Millisecond)
+
+	// a page of another site can't connect
+	header := http.Header{"Origin": []string{"https://evil.example"}}
+	_, r, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", header)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, http.StatusForbidden, r.StatusCode)
+	}
+	header.Set("Origin", server.URL)
+	same, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", header)
+	if assert.NoError(t, err) {
+		same.Close()
+	}
+
+	assert.NoError(t, ws.RunOnce(context.Background()))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	kind, data, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, kind)
+
+	var frame liveFrame
+	assert.NoError(t, json.Unmarshal(data, &frame))
+	assert.False(t, frame.Time.IsZero())
+	assert.Equal(t, []liveSample{
+		{Labels: map[string]string{"ssid": "home"}, Value: 42},
+	}, frame.Metrics["signal"])
+	assert.Equal(t, []liveSample{
+		{Labels: map[string]string{"id": "signal"}, Value: 1},
+	}, frame.Metrics["watchmon_monitor_up"])
+
+	// the client is closed when the watch service stops
+	ws.live.close()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+}
+
+func Test_liveHub_slowClient(t *testing.T) {
+	hub := newLiveHub()
+	slow, unsubscribe := hub.subscribe()
+	defer unsubscribe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*liveBuffer; i++ {
+			hub.broadcast([]byte("{}"))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broadcast blocked on a slow client")
+	}
+	assert.Len(t, slow, liveBuffer)
+
+	unsubscribe()
+	assert.False(t, hub.active())
+	hub.close()
+	closed, _ := hub.subscribe()
+	_, ok := <-closed
+	assert.False(t, ok)
+}
@@ -12,6 +12,7 @@ func newLogger(module string) func(logger string) *log.Entry {
 }
 
 var (
+	appLog    = newLogger("app")
 	configLog = newLogger("config")
 	httpLog   = newLogger("http")
 	watchLog  = newLogger("watch")
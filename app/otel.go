@@ -0,0 +1,137 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	otelapi "go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// newOTLPReader returns the reader exporting the OTel metrics to the OTLP
+// endpoint, replaced by tests with an in-memory reader.
+var newOTLPReader = func(c OTLPConfig) (sdkmetric.Reader, error) {
+	var opts []otlpmetrichttp.Option
+	if c.Endpoint != "" {
+		opts = append(opts, otlpmetrichttp.WithEndpointURL(c.Endpoint))
+	}
+	if len(c.Headers) > 0 {
+		opts = append(opts, otlpmetrichttp.WithHeaders(c.Headers))
+	}
+	exporter, err := otlpmetrichttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("otlp: %v", err)
+	}
+	var readerOpts []sdkmetric.PeriodicReaderOption
+	if c.Interval > 0 {
+		readerOpts = append(readerOpts, sdkmetric.WithInterval(c.Interval))
+	}
+	return sdkmetric.NewPeriodicReader(exporter, readerOpts...), nil
+}
+
+// newMeterProvider returns the meter provider exporting the monitors
+// metrics to the OTLP endpoint.
+func newMeterProvider(c OTLPConfig) (*sdkmetric.MeterProvider, error) {
+	reader, err := newOTLPReader(c)
+	if err != nil {
+		return nil, err
+	}
+	return sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "watchmon"),
+			attribute.String("service.version", Version),
+		)),
+	), nil
+}
+
+// flushOTel exports the OTel metrics recorded so far, if configured.
+func (ws *WatchService) flushOTel(ctx context.Context) error {
+	if ws.meterProvider == nil {
+		return nil
+	}
+	if err := ws.meterProvider.ForceFlush(ctx); err != nil {
+		return fmt.Errorf("otlp: %v", err)
+	}
+	return nil
+}
+
+// shutdownOTel exports the OTel metrics left and stops the exporter.
+func (ws *WatchService) shutdownOTel() {
+	if ws.meterProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	if err := ws.meterProvider.Shutdown(ctx); err != nil {
+		watchLog("WatchService").WithError(err).Warn("OTLP exporter shutdown failure")
+	}
+}
+
+// otelMetric records the monitor values to an OTel observable gauge, the
+// values written are observed at every collection until deleted.
+type otelMetric struct {
+	names []string
+
+	mu     sync.Mutex
+	values map[string]otelValue
+}
+
+type otelValue struct {
+	attrs attribute.Set
+	value float64
+}
+
+// newOTelMetric returns the metric recording to a gauge of the meter named
+// after the monitor, with the label names as attribute keys.
+func newOTelMetric(meter otelapi.Meter, m *Monitor, names []string) (*otelMetric, error) {
+	g := &otelMetric{names: names, values: map[string]otelValue{}}
+	_, err := meter.Float64ObservableGauge(
+		m.c.metricName(),
+		otelapi.WithDescription(m.c.Title),
+		otelapi.WithFloat64Callback(g.observe),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *otelMetric) observe(_ context.Context, o otelapi.Float64Observer) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, v := range g.values {
+		o.Observe(v.value, otelapi.WithAttributeSet(v.attrs))
+	}
+	return nil
+}
+
+func (g *otelMetric) Write(monitor *Monitor, m metric) error {
+	labels := monitor.gaugeLabels(m.labels)
+	if len(labels) != len(g.names) {
+		return fmt.Errorf("otel: %d label values for %d labels", len(labels), len(g.names))
+	}
+	attrs := make([]attribute.KeyValue, len(labels))
+	for i, l := range labels {
+		attrs[i] = attribute.String(g.names[i], l)
+	}
+	g.mu.Lock()
+	g.values[seriesKey(labels)] = otelValue{attribute.NewSet(attrs...), m.value}
+	g.mu.Unlock()
+	watchLog("otelMetric").WithField("metric", monitor.c.Id).Debugf("Written: %v %f", m.labels, m.value)
+	return nil
+}
+
+func (g *otelMetric) Delete(monitor *Monitor, labels []string) bool {
+	key := seriesKey(monitor.gaugeLabels(labels))
+	g.mu.Lock()
+	_, deleted := g.values[key]
+	delete(g.values, key)
+	g.mu.Unlock()
+	watchLog("otelMetric").WithField("metric", monitor.c.Id).Debugf("Deleted: %v %t", labels, deleted)
+	return deleted
+}
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func Test_WatchService_otlp(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	defer func(f func(OTLPConfig) (sdkmetric.Reader, error)) { newOTLPReader = f }(newOTLPReader)
+	newOTLPReader = func(OTLPConfig) (sdkmetric.Reader, error) { return reader, nil }
+
+	ws := NewWatchService(AppConfig{
+		Monitors: []MonitorConfig{
+			{Id: "signal", Value: MonitorValueConfig{SourceId: "network", RecordId: "wifi", Header: "signal",
+				Labels: []MonitorValueLabelConfig{{Header: "ssid"}}}},
+		},
+		Sources: []SourceConfig{
+			{Id: "network", Command: "echo home:42", Output: SourceOutputConfig{
+				Parser:  "csv",
+				Records: []ParserRecordConfig{{Id: "wifi", Header: []string{"ssid", "signal"}}},
+			}},
+		},
+		Exporter: "otlp",
+	})
+	assert.NoError(t, ws.RunOnce(context.Background()))
+
+	collect := func() []metricdata.DataPoint[float64] {
+		var rm metricdata.ResourceMetrics
+		assert.NoError(t, reader.Collect(context.Background(), &rm))
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name == "signal" {
+					return m.Data.(metricdata.Gauge[float64]).DataPoints
+				}
+			}
+		}
+		return nil
+	}
+	points := collect()
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, 42.0, points[0].Value)
+		assert.Equal(t, attribute.NewSet(attribute.String("ssid", "home")), points[0].Attributes)
+	}
+
+	// the monitor is exported instead of served
+	families, err := ws.registry.Gather()
+	assert.NoError(t, err)
+	for _, f := range families {
+		assert.NotEqual(t, "signal", f.GetName())
+	}
+
+	m := ws.monitors[0]
+	assert.True(t, m.metric.Delete(m, []string{"home"}))
+	assert.False(t, m.metric.Delete(m, []string{"home"}))
+	assert.Empty(t, collect())
+}
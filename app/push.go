@@ -0,0 +1,55 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// DefaultPushgatewayJob is the Pushgateway job used when the config sets
+// none.
+const DefaultPushgatewayJob = "watchmon"
+
+// pushBackoff is the delay before the first push retry, doubled on every
+// following retry.
+var pushBackoff = 500 * time.Millisecond
+
+// pushMetrics pushes the registry to the configured Pushgateway, without the
+// Go runtime and process metrics, retrying failed pushes until ctx is done.
+func (ws *WatchService) pushMetrics(ctx context.Context) error {
+	c := ws.pushgateway
+	if c.URL == "" {
+		return nil
+	}
+	job := c.Job
+	if job == "" {
+		job = DefaultPushgatewayJob
+	}
+	pusher := push.New(c.URL, job).
+		Gatherer(ws.exportGatherer()).
+		Client(&http.Client{Timeout: DefaultTimeout})
+	for name, value := range c.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+
+	backoff := pushBackoff
+	for retry := 0; ; retry++ {
+		err := pusher.Push()
+		if err == nil {
+			return nil
+		}
+		if retry >= c.Retries {
+			return fmt.Errorf("pushgateway: %v", err)
+		}
+		watchLog("WatchService").WithError(err).Debugf("Push failure, retry in %s", backoff)
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
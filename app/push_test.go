@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WatchService_pushMetrics(t *testing.T) {
+	defer func(d time.Duration) { pushBackoff = d }(pushBackoff)
+	pushBackoff = 1 * time.Millisecond
+
+	var (
+		mu       sync.Mutex
+		requests []string
+		families = map[string]*dto.MetricFamily{}
+		failures = 1
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if failures > 0 {
+			failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			var mf dto.MetricFamily
+			if err := dec.Decode(&mf); err != nil {
+				break
+			}
+			families[mf.GetName()] = &mf
+		}
+	}))
+	defer ts.Close()
+
+	ws := NewWatchService(AppConfig{
+		Monitors: []MonitorConfig{
+			{Id: "signal", Value: MonitorValueConfig{SourceId: "network", RecordId: "wifi", Header: "signal"}},
+		},
+		Sources: []SourceConfig{
+			{
+				Id:      "network",
+				Command: "echo 42",
+				Output: SourceOutputConfig{
+					Parser:  "csv",
+					Records: []ParserRecordConfig{{Id: "wifi", Header: []string{"signal"}}},
+				},
+			},
+		},
+		Pushgateway: PushgatewayConfig{
+			URL:      ts.URL,
+			Grouping: map[string]string{"instance": "router"},
+			Retries:  2,
+		},
+	})
+
+	err := ws.RunOnce(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"PUT /metrics/job/watchmon/instance/router",
+		"PUT /metrics/job/watchmon/instance/router",
+	}, requests)
+	if assert.Contains(t, families, "signal") {
+		assert.Equal(t, 42.0, families["signal"].GetMetric()[0].GetGauge().GetValue())
+	}
+	assert.Contains(t, families, "watchmon_build_info")
+	for name := range families {
+		assert.False(t, strings.HasPrefix(name, "go_") || strings.HasPrefix(name, "process_"), name)
+	}
+
+	failures = 3
+	requests = nil
+	err = ws.RunOnce(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "pushgateway: unexpected status code 503")
+	assert.Len(t, requests, 3)
+}
+
+type countParser struct {
+	n atomic.Int64
+}
+
+func (p *countParser) Parse(source *Source, reader io.Reader) (records, error) {
+	return records{"r": []record{{"v": strconv.FormatInt(p.n.Add(1), 10)}}}, nil
+}
+
+func Test_WatchService_Start_pushOrder(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		first  = true
+		pushed []float64
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		slow := first
+		first = false
+		mu.Unlock()
+		if slow {
+			// the oldest batch push arrives after the newer batches are pulled
+			time.Sleep(100 * time.Millisecond)
+		}
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			var mf dto.MetricFamily
+			if err := dec.Decode(&mf); err != nil {
+				break
+			}
+			if mf.GetName() == "signal" {
+				mu.Lock()
+				pushed = append(pushed, mf.GetMetric()[0].GetGauge().GetValue())
+				mu.Unlock()
+			}
+		}
+	}))
+	defer ts.Close()
+
+	ws := NewWatchService(AppConfig{
+		Monitors: []MonitorConfig{
+			{Id: "signal", Value: MonitorValueConfig{SourceId: "network", RecordId: "r", Header: "v"}},
+		},
+		Sources: []SourceConfig{
+			{Id: "network", Command: "true", Output: SourceOutputConfig{Parser: "csv"}},
+		},
+		Pushgateway: PushgatewayConfig{URL: ts.URL},
+	})
+	ws.sources[0].command = &testCommand{}
+	ws.sources[0].parser = &countParser{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, ws.Start(ctx, 10*time.Millisecond))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Greater(t, len(pushed), 1) {
+		assert.True(t, sort.Float64sAreSorted(pushed), "pushed out of order: %v", pushed)
+		assert.Equal(t, 1.0, pushed[0])
+	}
+}
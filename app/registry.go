@@ -0,0 +1,146 @@
+package app
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Record and Records are the parsed source rows, exported for
+	// implementing Parser outside the package.
+	Record  = record
+	Records = records
+
+	// Value is a single metric value written by Metric.
+	Value = metric
+)
+
+// Labels returns the label values of the metric.
+func (m metric) Labels() []string {
+	return m.labels
+}
+
+// Value returns the value of the metric.
+func (m metric) Value() float64 {
+	return m.value
+}
+
+// Timestamp returns the sample time read from the source, zero if none.
+func (m metric) Timestamp() time.Time {
+	return m.timestamp
+}
+
+// Config returns the config of the source, for the commands and parsers
+// implemented outside the package.
+func (s *Source) Config() SourceConfig {
+	return s.c
+}
+
+// Config returns the config of the monitor, for the metrics implemented
+// outside the package.
+func (m *Monitor) Config() MonitorConfig {
+	return m.c
+}
+
+var plugins = struct {
+	mu       sync.RWMutex
+	parsers  map[string]func() Parser
+	commands map[string]func() Command
+	metrics  map[string]func() Metric
+}{
+	parsers: map[string]func() Parser{
+		"csv":        func() Parser { return &csvParser{} },
+		"htmlquery":  func() Parser { return &htmlqueryParser{} },
+		"prometheus": func() Parser { return &promParser{} },
+	},
+	commands: map[string]func() Command{
+		"shell":  func() Command { return &shellCommand{} },
+		"file":   func() Command { return &fileCommand{} },
+		"tcp":    func() Command { return &tcpCommand{} },
+		"unix":   func() Command { return &unixCommand{} },
+		"http":   func() Command { return &httpCommand{} },
+		"stream": func() Command { return &streamCommand{} },
+	},
+	metrics: map[string]func() Metric{
+		"gauge": func() Metric { return &gaugeMetric{} },
+	},
+}
+
+// RegisterParser makes a parser available by name as a source output parser.
+func RegisterParser(name string, factory func() Parser) {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	plugins.parsers[name] = factory
+}
+
+// RegisterCommand makes a command available by name as a source type.
+func RegisterCommand(name string, factory func() Command) {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	plugins.commands[name] = factory
+}
+
+// RegisterMetric makes a metric available by name as a monitor type.
+func RegisterMetric(name string, factory func() Metric) {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	plugins.metrics[name] = factory
+}
+
+func newParser(name string) Parser {
+	plugins.mu.RLock()
+	defer plugins.mu.RUnlock()
+	if factory, ok := plugins.parsers[name]; ok {
+		return factory()
+	}
+	return nil
+}
+
+func newCommand(name string) Command {
+	plugins.mu.RLock()
+	defer plugins.mu.RUnlock()
+	if factory, ok := plugins.commands[name]; ok {
+		return factory()
+	}
+	return nil
+}
+
+// parserNames returns the registered source output parsers in name order.
+func parserNames() []string {
+	plugins.mu.RLock()
+	defer plugins.mu.RUnlock()
+	return sortedNames(plugins.parsers)
+}
+
+// commandNames returns the registered source types in name order.
+func commandNames() []string {
+	plugins.mu.RLock()
+	defer plugins.mu.RUnlock()
+	return sortedNames(plugins.commands)
+}
+
+// metricNames returns the registered monitor types in name order.
+func metricNames() []string {
+	plugins.mu.RLock()
+	defer plugins.mu.RUnlock()
+	return sortedNames(plugins.metrics)
+}
+
+func sortedNames[F any](factories map[string]F) []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newMetric(name string) Metric {
+	plugins.mu.RLock()
+	defer plugins.mu.RUnlock()
+	if factory, ok := plugins.metrics[name]; ok {
+		return factory()
+	}
+	return nil
+}
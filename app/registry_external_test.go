@@ -0,0 +1,78 @@
+package app_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	watchmon "github.com/realitycheck/watchmon/app"
+	"github.com/stretchr/testify/assert"
+)
+
+// lineCommand outputs its source command as is.
+type lineCommand struct{}
+
+func (lineCommand) Execute(ctx context.Context, source *watchmon.Source) ([]byte, error) {
+	return []byte(source.Config().Command), nil
+}
+
+// wordsParser reads every word of the input as a row of the source records.
+type wordsParser struct{}
+
+func (wordsParser) Parse(source *watchmon.Source, r io.Reader) (watchmon.Records, error) {
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	res := watchmon.Records{}
+	for _, rc := range source.Config().Output.Records {
+		for _, word := range strings.Fields(string(input)) {
+			res[rc.Id] = append(res[rc.Id], watchmon.Record{rc.Header[0]: word})
+		}
+	}
+	return res, nil
+}
+
+// recordingMetric records the values written by monitor id.
+type recordingMetric struct {
+	mu      sync.Mutex
+	written map[string][]float64
+}
+
+func (m *recordingMetric) Write(monitor *watchmon.Monitor, v watchmon.Value) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := monitor.Config().Id
+	m.written[id] = append(m.written[id], v.Value())
+	return nil
+}
+
+func (m *recordingMetric) Delete(monitor *watchmon.Monitor, labels []string) bool {
+	return false
+}
+
+func Test_RegisterParser(t *testing.T) {
+	t.Cleanup(func() { watchmon.UnregisterPlugins("words") })
+	metric := &recordingMetric{written: map[string][]float64{}}
+	watchmon.RegisterCommand("words", func() watchmon.Command { return lineCommand{} })
+	watchmon.RegisterParser("words", func() watchmon.Parser { return wordsParser{} })
+	watchmon.RegisterMetric("words", func() watchmon.Metric { return metric })
+
+	ws := watchmon.NewWatchService(watchmon.AppConfig{
+		Monitors: []watchmon.MonitorConfig{
+			{Id: "count", Type: "words", Value: watchmon.MonitorValueConfig{
+				SourceId: "s", RecordId: "r", Header: "word", Format: "%f",
+			}},
+		},
+		Sources: []watchmon.SourceConfig{
+			{Id: "s", Type: "words", Command: "7", Output: watchmon.SourceOutputConfig{
+				Parser:  "words",
+				Records: []watchmon.ParserRecordConfig{{Id: "r", Header: []string{"word"}}},
+			}},
+		},
+	})
+	assert.NoError(t, ws.RunOnce(context.Background()))
+	assert.Equal(t, map[string][]float64{"count": {7}}, metric.written)
+}
@@ -0,0 +1,23 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RegisterParser_defaults(t *testing.T) {
+	ws := NewWatchService(AppConfig{
+		Sources: []SourceConfig{
+			{Id: "default", Output: SourceOutputConfig{Parser: "csv"}},
+		},
+	})
+	assert.IsType(t, &shellCommand{}, ws.sources[0].command)
+	assert.IsType(t, &csvParser{}, ws.sources[0].parser)
+}
+
+func Test_Value(t *testing.T) {
+	v := Value{labels: []string{"a"}, value: 1}
+	assert.Equal(t, []string{"a"}, v.Labels())
+	assert.Equal(t, 1.0, v.Value())
+}
@@ -99,15 +99,22 @@ Monitor.prototype.render = function (metrics) {
         var t = new Date().getTime();
 
         for (var g in this.graphs) {
-            if (!metrics[g]) {
-                continue;
-            }
-            
-            for (var i in metrics[g]) {
-                this.graphs[g].renderMetric(t, metrics[g][i]);
+            var options = this.graphs[g].options;
+            var names = options.metricNames || [options.metricName || g];
+            var rendered = false;
+            for (var name of names) {
+                if (!metrics[name]) {
+                    continue;
+                }
+                for (var i in metrics[name]) {
+                    this.graphs[g].renderMetric(t, metrics[name][i], names.length > 1 ? name : "");
+                }
+                rendered = true;
             }
 
-            this.graphs[g].renderLegend();
+            if (rendered) {
+                this.graphs[g].renderLegend();
+            }
         }
     }
 };
@@ -142,8 +149,25 @@ function Graph(name, graphOptions) {
     this.name = name;
     this.options = graphOptions;
 
-    this.chart = new SmoothieChart(this.options.chartOptions);
+    var chartOptions = this.options.chartOptions || {};
+    if (chartOptions.logScale) {
+        // the chart draws log10 values, label the axis with the real ones
+        var formatter = (v, precision) => Math.pow(10, v).toPrecision(precision || 2);
+        chartOptions = Object.assign({
+            yMinFormatter: formatter,
+            yMaxFormatter: formatter,
+        }, chartOptions);
+    }
+    this.logScale = !!chartOptions.logScale;
+    this.stacked = !!chartOptions.stacked;
+    this.stack = {time: null, sum: 0};
+
+    this.chart = new SmoothieChart(chartOptions);
     this.series = {};
+
+    var timeOptions = this.options.timeOptions || {};
+    this.retention = (timeOptions.retentionSeconds || 0) * 1000;
+    this.maxPoints = timeOptions.maxPoints || 0;
     this.chart.streamTo(
         document.querySelector(this.options.chartCanvas),
         this.options.chartDelay
@@ -155,24 +179,68 @@ function Graph(name, graphOptions) {
     }
 } 
 
-Graph.prototype.renderMetric = function (time, metric) {
-    var series = this.series[metric.labels];
+Graph.prototype.renderMetric = function (time, metric, prefix) {
+    // series of a multi-monitor graph are prefixed by their metric name
+    var key = (prefix || "") + (metric.labels || "");
+    var series = this.series[key];
     if (!series) {
-        var timeOptions = patternOptions(this.options.timeOptions, metric.labels);
-        var seriesOptions = patternOptions(this.options.seriesOptions, metric.labels);
+        var count = Object.keys(this.series).length;
+        if (this.options.maxSeries && count >= this.options.maxSeries) {
+            return;
+        }
+        var timeOptions = patternOptions(this.options.timeOptions, key);
+        var seriesOptions = patternOptions(this.options.seriesOptions, key);
+        var palette = this.options.palette;
+        if (palette && palette.length > 0 && !seriesOptions.strokeStyle) {
+            seriesOptions = Object.assign({}, seriesOptions, {
+                strokeStyle: palette[count % palette.length]
+            });
+        }
 
         var ts = new TimeSeries(timeOptions);
         this.chart.addTimeSeries(ts, seriesOptions);
-        series = this.series[metric.labels] = {
+        series = this.series[key] = {
             ts: ts,
             options: this.chart.seriesSet[this.chart.seriesSet.length-1].options,
         };
     }
 
     // console.debug("render metric:", metric.val, metric.labels);
-    if (metric.val) {
-        series.ts.append(time, metric.val);
-    }    
+    series.value = metric.val;
+    var val = metric.val;
+    if (this.stacked) {
+        // each series is drawn over the sum of the ones rendered before
+        if (this.stack.time !== time) {
+            this.stack = {time: time, sum: 0};
+        }
+        val = this.stack.sum += val || 0;
+    }
+    if (this.logScale) {
+        // log10(1) is 0, drawn unlike zero values
+        if (val > 0) {
+            series.ts.append(time, Math.log10(val));
+        }
+    } else if (val) {
+        series.ts.append(time, val);
+    }
+    this.trim(series.ts, time);
+};
+
+// trim drops the points out of the retention window, keeping the last one
+// for the legend.
+Graph.prototype.trim = function (ts, time) {
+    var drop = 0;
+    if (this.maxPoints && ts.data.length > this.maxPoints) {
+        drop = ts.data.length - this.maxPoints;
+    }
+    if (this.retention) {
+        while (drop < ts.data.length - 1 && ts.data[drop][0] < time - this.retention) {
+            ++drop;
+        }
+    }
+    if (drop > 0) {
+        ts.data.splice(0, drop);
+    }
 };
 
 Graph.prototype.renderLegend = function () {
@@ -185,9 +253,7 @@ Graph.prototype.renderLegend = function () {
     ];
     for (var s of Object.entries(this.series).sort(
         (s1, s2) => {
-            var i1 = s1[1].ts.data.length - 1;
-            var i2 = s2[1].ts.data.length - 1;
-            return  s2[1].ts.data[i2][1] - s1[1].ts.data[i1][1];
+            return (s2[1].value || 0) - (s1[1].value || 0);
         }
     )) {
         var series = s[1];
@@ -196,12 +262,11 @@ Graph.prototype.renderLegend = function () {
             "background: " + series.options.strokeStyle + ";'></div>",
         ].join(" ");
         
-        var i = series.ts.data.length - 1;
         innerHTML.push(
             "<tr>",            
             "<td>", s[0], "</td>",
             "<td>", box, "</td>",
-            "<td>", series.ts.data[i][1], "</td>",
+            "<td>", series.value, "</td>",
             "</tr>"
         );
     }
@@ -214,7 +279,12 @@ function patternOptions(options, match) {
     if (options) {        
         var re = /^\/\/?(.+)\/\/?(.+)?$/u;
         for (var pattern in options) {
-            var [_, regex, flags] = re.exec(pattern);
+            var m = re.exec(pattern);
+            if (!m) {
+                // not a pattern, e.g. retentionSeconds
+                continue;
+            }
+            var [_, regex, flags] = m;
             var pattern_re = new RegExp(regex, flags);
             if (pattern_re.test(match)) {
                 return options[pattern];
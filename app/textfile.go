@@ -0,0 +1,62 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// writeTextfile writes the registry in the text exposition format to the
+// configured textfile path, for the node_exporter textfile collector. The
+// file is written to a temporary file renamed over the path, so the
+// collector never reads a partial file. Writes closer than the textfile
+// interval to the previous one are skipped.
+func (ws *WatchService) writeTextfile() error {
+	c := ws.textfile
+	if c.Path == "" {
+		return nil
+	}
+	ws.textfileMu.Lock()
+	defer ws.textfileMu.Unlock()
+	if c.Interval > 0 && time.Since(ws.textfileWritten) < c.Interval {
+		return nil
+	}
+
+	families, err := ws.exportGatherer().Gather()
+	if err != nil {
+		return fmt.Errorf("textfile: %v", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(c.Path), "."+filepath.Base(c.Path)+".*")
+	if err != nil {
+		return fmt.Errorf("textfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	for _, mf := range families {
+		if _, err = expfmt.MetricFamilyToText(w, mf); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.Path)
+	}
+	if err != nil {
+		return fmt.Errorf("textfile: %v", err)
+	}
+	ws.textfileWritten = time.Now()
+	return nil
+}
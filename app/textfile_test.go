@@ -0,0 +1,49 @@
+package app
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WatchService_writeTextfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watchmon.prom")
+	ws := NewWatchService(AppConfig{
+		Monitors: []MonitorConfig{
+			{Id: "signal", Value: MonitorValueConfig{SourceId: "network", RecordId: "wifi", Header: "signal"}},
+		},
+		Sources: []SourceConfig{
+			{Id: "network", Command: "echo 42", Output: SourceOutputConfig{
+				Parser:  "csv",
+				Records: []ParserRecordConfig{{Id: "wifi", Header: []string{"signal"}}},
+			}},
+		},
+		Textfile: TextfileConfig{Path: path, Interval: time.Hour},
+	})
+
+	assert.NoError(t, ws.RunOnce(context.Background()))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "# TYPE signal gauge\nsignal 42\n")
+	assert.Contains(t, string(data), "watchmon_monitor_up{id=\"signal\"} 1\n")
+	assert.NotContains(t, string(data), "go_goroutines")
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary file left behind")
+
+	// within the interval, the file is left as is
+	assert.NoError(t, os.WriteFile(path, nil, 0644))
+	assert.NoError(t, ws.RunOnce(context.Background()))
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+
+	ws.textfile.Path = filepath.Join(path, "missing", "watchmon.prom")
+	ws.textfile.Interval = 0
+	assert.Error(t, ws.RunOnce(context.Background()))
+}
@@ -1,20 +1,46 @@
 package app
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"sync"
 
 	"os/exec"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/andybalholm/cascadia"
 	"github.com/antchfx/htmlquery"
+	"github.com/antchfx/xpath"
 	"golang.org/x/net/html"
+	"golang.org/x/text/encoding/htmlindex"
 
 	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	otelapi "go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 )
 
 type (
@@ -22,12 +48,14 @@ type (
 	record  map[string]string
 	records map[string][]record
 	metric  struct {
-		labels []string
-		value  float64
+		labels    []string
+		value     float64
+		timestamp time.Time
 	}
 
 	Metric interface {
 		Write(monitor *Monitor, m metric) error
+		Delete(monitor *Monitor, labels []string) bool
 	}
 
 	Parser interface {
@@ -35,59 +63,209 @@ type (
 	}
 
 	Command interface {
-		Execute(source *Source) ([]byte, error)
+		Execute(ctx context.Context, source *Source) ([]byte, error)
 	}
 
 	gaugeMetric     struct{}
 	csvParser       struct{}
 	htmlqueryParser struct{}
+	promParser      struct{}
 	shellCommand    struct{}
+	fileCommand     struct{}
+	tcpCommand      struct{}
+	unixCommand     struct{}
+	httpCommand     struct{}
+	streamCommand   struct {
+		mu      sync.Mutex
+		buf     bytes.Buffer
+		started bool
+		err     error
+	}
 )
 
 type WatchService struct {
 	monitors []*Monitor
 	sources  []*Source
+
+	registry          *prom.Registry
+	sourceLastSuccess *prom.GaugeVec
+	monitorSeries     *prom.GaugeVec
+	monitorUp         *prom.GaugeVec
+	parseWarnings     *prom.CounterVec
+	pushgateway       PushgatewayConfig
+
+	textfile        TextfileConfig
+	textfileMu      sync.Mutex
+	textfileWritten time.Time
+
+	// meterProvider exports the monitors metrics to OTLP instead of the
+	// registry, set by the otlp exporter config
+	meterProvider *sdkmetric.MeterProvider
+
+	statusMu sync.Mutex
+	status   map[string]SourceStatus
+	warnings map[string]int
+
+	live *liveHub
+
+	// onCycle is called after every source pull, if set
+	onCycle func(sourceId string, recs Records, err error)
+
+	// ready is closed when the first push cycle completes
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	randMu sync.Mutex
+	rand   *rand.Rand
 }
 
 type Monitor struct {
-	c      MonitorConfig
-	gauge  *prom.GaugeVec
-	metric Metric
+	c          MonitorConfig
+	gauge      *prom.GaugeVec
+	timestamps *timestampCollector
+	metric     Metric
+	maxSeries  int
+
+	// mu guards the push state below, pushes of batches may overlap
+	mu sync.Mutex
+
+	// series are the label sets written, capped to maxCardinality
+	series         map[string][]string
+	maxCardinality int
+	capped         bool
+
+	// rates are the previous samples of the Rate series
+	rates map[string]rateSample
+	now   func() time.Time
+}
+
+type rateSample struct {
+	value float64
+	time  time.Time
+}
+
+// timestampCollector exposes the gauges with the sample times written
+// along with their values instead of the scrape time.
+type timestampCollector struct {
+	*prom.GaugeVec
+	labelNames []string
+
+	mu         sync.Mutex
+	timestamps map[string]time.Time
+}
+
+// Pull failures wrap one of these errors, keeping their own message.
+var (
+	ErrCommandFailed = errors.New("command failed")
+	ErrTimeout       = errors.New("timeout")
+	ErrParseFailed   = errors.New("parse failed")
+)
+
+// pullError classifies a source pull failure as one of the Err* errors.
+type pullError struct {
+	kind error
+	err  error
+}
+
+func (e *pullError) Error() string        { return e.err.Error() }
+func (e *pullError) Unwrap() error        { return e.err }
+func (e *pullError) Is(target error) bool { return target == e.kind }
+
+// commandError classifies a command failure as ErrTimeout or
+// ErrCommandFailed.
+func commandError(err error) error {
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return &pullError{ErrTimeout, err}
+	}
+	return &pullError{ErrCommandFailed, err}
 }
 
 type Source struct {
 	c       SourceConfig
 	command Command
 	parser  Parser
+	stages  []Parser
 }
 
+// Version is the watchmon build version, set at build time with
+// -ldflags "-X github.com/realitycheck/watchmon/app.Version=...".
+var Version = "dev"
+
 func NewWatchService(config AppConfig) *WatchService {
-	ws := &WatchService{
-		make([]*Monitor, len(config.Monitors)),
-		make([]*Source, len(config.Sources)),
+	ws := newWatchService()
+	buildInfo := prom.NewGauge(prom.GaugeOpts{
+		Name: "watchmon_build_info",
+		Help: "Build version and loaded config hash, always 1.",
+		ConstLabels: prom.Labels{
+			"version":     Version,
+			"config_hash": config.Hash(),
+		},
+	})
+	buildInfo.Set(1)
+	ws.registry.MustRegister(buildInfo)
+	ws.pushgateway = config.Pushgateway
+	ws.textfile = config.Textfile
+	var meter otelapi.Meter
+	if config.Exporter == "otlp" {
+		mp, err := newMeterProvider(config.OTLP)
+		if err != nil {
+			watchLog("WatchService").WithError(err).Error("OTLP exporter failure, metrics served only")
+		} else {
+			ws.meterProvider = mp
+			meter = mp.Meter("github.com/realitycheck/watchmon")
+		}
 	}
+	ws.monitors = make([]*Monitor, len(config.Monitors))
+	ws.sources = make([]*Source, len(config.Sources))
 
+	maxSeries := map[string]int{}
+	for _, g := range config.Graphs {
+		maxSeries[g.Id] = g.MaxSeries
+	}
 	for i, c := range config.Monitors {
-		ws.monitors[i] = &Monitor{c: c}
+		ws.monitors[i] = &Monitor{c: c, maxSeries: maxSeries[c.Id], maxCardinality: config.MaxCardinality}
 		m := ws.monitors[i]
 
-		if m.c.Value.Format == "" {
-			m.c.Value.Format = "%f"
-		}
+		m.c.setDefaults()
 
-		if m.c.Type == "" {
-			m.c.Type = "gauge"
+		if name := m.c.metricName(); name != m.c.MetricName && name != m.c.Id {
+			watchLog("WatchService").WithField("monitor", m.c.Id).Infof("Metric name sanitized as %q", name)
 		}
 
-		switch m.c.Type {
-		case "gauge":
+		if m.c.Type == "gauge" && meter != nil {
+			names := labelNames(m.c.Value.Labels)
+			if m.c.AddSourceLabel {
+				names = append(names, SourceLabel)
+			}
+			metric, err := newOTelMetric(meter, m, names)
+			if err != nil {
+				watchLog("WatchService").WithField("monitor", m.c.Id).WithError(err).Error("OTel gauge failure, monitor disabled")
+				continue
+			}
+			m.metric = metric
+			continue
+		}
+		if m.c.Type == "gauge" {
+			names := labelNames(m.c.Value.Labels)
+			if m.c.AddSourceLabel {
+				names = append(names, SourceLabel)
+			}
 			m.gauge = prom.NewGaugeVec(
 				prom.GaugeOpts{
-					Name: m.c.Id,
+					Name: m.c.metricName(),
 					Help: m.c.Title,
-				}, labelNames(m.c.Value.Labels))
-			prom.MustRegister(m.gauge)
-			m.metric = &gaugeMetric{}
+				}, names)
+			if m.c.Value.TimestampHeader != "" {
+				m.timestamps = newTimestampCollector(m.gauge, names)
+				ws.registry.MustRegister(m.timestamps)
+			} else {
+				ws.registry.MustRegister(m.gauge)
+			}
+		}
+		m.metric = newMetric(m.c.Type)
+		if m.metric == nil {
+			watchLog("WatchService").WithField("monitor", m.c.Id).Errorf("Unknown monitor type %q, monitor disabled", m.c.Type)
 		}
 	}
 
@@ -95,225 +273,1998 @@ func NewWatchService(config AppConfig) *WatchService {
 		ws.sources[i] = &Source{c: c}
 		s := ws.sources[i]
 
-		s.command = &shellCommand{}
-		switch s.c.Output.Parser {
-		case "csv":
-			s.parser = &csvParser{}
-		case "htmlquery":
-			s.parser = &htmlqueryParser{}
+		s.c.setDefaults(config)
+		s.command = newCommand(s.c.Type)
+		s.parser = newParser(s.c.Output.Parser)
+		for _, st := range s.c.Output.Stages {
+			s.stages = append(s.stages, newParser(st.Parser))
 		}
 	}
 	return ws
 }
 
+func newWatchService() *WatchService {
+	ws := &WatchService{
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		registry: prom.NewRegistry(),
+		live:     newLiveHub(),
+		ready:    make(chan struct{}),
+		sourceLastSuccess: prom.NewGaugeVec(
+			prom.GaugeOpts{
+				Name: "watchmon_source_last_success_timestamp_seconds",
+				Help: "Time of the last successful source pull.",
+			}, []string{"source"}),
+		monitorSeries: prom.NewGaugeVec(
+			prom.GaugeOpts{
+				Name: "watchmon_monitor_series",
+				Help: "Number of series written by the monitor.",
+			}, []string{"monitor"}),
+		monitorUp: prom.NewGaugeVec(
+			prom.GaugeOpts{
+				Name: "watchmon_monitor_up",
+				Help: "Whether the monitor was updated by the last cycle.",
+			}, []string{"id"}),
+		parseWarnings: prom.NewCounterVec(
+			prom.CounterOpts{
+				Name: "watchmon_monitor_parse_warnings_total",
+				Help: "Number of records the monitor could not fully read, by reason.",
+			}, []string{"id", "reason"}),
+	}
+	ws.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ws.sourceLastSuccess,
+		ws.monitorSeries,
+		ws.monitorUp,
+		ws.parseWarnings,
+	)
+	return ws
+}
+
+// jitter returns a random delay in [0, max).
+func (ws *WatchService) jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	ws.randMu.Lock()
+	defer ws.randMu.Unlock()
+	return time.Duration(ws.rand.Int63n(int64(max)))
+}
+
+// Gatherer returns the registry holding the service metrics.
+func (ws *WatchService) Gatherer() prom.Gatherer {
+	return ws.registry
+}
+
+// exportGatherer returns the registry without the Go runtime and process
+// metrics, for the textfile and Pushgateway exports where they would collide
+// with the node_exporter and other pushers ones.
+func (ws *WatchService) exportGatherer() prom.Gatherer {
+	return prom.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := ws.registry.Gather()
+		res := families[:0]
+		for _, mf := range families {
+			if name := mf.GetName(); !strings.HasPrefix(name, "go_") && !strings.HasPrefix(name, "process_") {
+				res = append(res, mf)
+			}
+		}
+		return res, err
+	})
+}
+
+// gaugeLabels returns the gauge label values of the value labels.
+func (m *Monitor) gaugeLabels(labels []string) []string {
+	if !m.c.AddSourceLabel {
+		return labels
+	}
+	return append(labels[:len(labels):len(labels)], m.c.Value.SourceId)
+}
+
+// labelNames returns the label names of the value labels, their headers
+// sanitized to valid Prometheus label names.
 func labelNames(ll []MonitorValueLabelConfig) []string {
 	labelNames := make([]string, len(ll))
 	for i, l := range ll {
-		labelNames[i] = l.Header
+		labelNames[i] = sanitizeName(l.Header, false)
+		if labelNames[i] != l.Header {
+			watchLog("WatchService").WithField("header", l.Header).Infof("Label name sanitized as %q", labelNames[i])
+		}
 	}
 	return labelNames
 }
 
+// Start pulls the sources and pushes their records to the monitors every
+// refresh period until ctx is done, then returns once the pulls and pushes
+// in flight are done.
 func (ws *WatchService) Start(ctx context.Context, refresh time.Duration) error {
 	type SourcesData struct {
-		data    *sync.Map
-		updated time.Time
+		data *sync.Map
+		seq  uint64
 	}
 	sourcesData := make(chan SourcesData)
-	latest := struct {
-		mu *sync.Mutex
-		t  time.Time
-	}{
-		mu: &sync.Mutex{},
-	}
+	var (
+		order  batchOrder
+		pushMu sync.Mutex
+		wg     sync.WaitGroup
+	)
 
+	backoff := newSourceBackoff(refresh)
+	defer ws.live.close()
+	defer ws.shutdownOTel()
+	defer wg.Wait()
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-time.After(refresh):
+			seq := order.next()
+			wg.Add(1)
 			go func() {
-				updated := time.Now()
-				data := &sync.Map{}
-				wg := sync.WaitGroup{}
-				wg.Add(len(ws.sources))
-				for _, source := range ws.sources {
-					go func(s *Source) {
-						records, err := s.pull()
-						if err != nil {
-							watchLog("WatchService").WithError(err).WithField("source", s.c.Id).Warn("Source refresh failure")
-						} else {
-							data.Store(s.c.Id, records)
-						}
-						wg.Done()
-					}(source)
+				defer wg.Done()
+				data := ws.pullSources(ctx, backoff)
+				select {
+				case sourcesData <- SourcesData{data, seq}:
+				case <-ctx.Done():
 				}
-				wg.Wait()
-				sourcesData <- SourcesData{data, updated}
 			}()
 		case sources := <-sourcesData:
-			latest.mu.Lock()
-			t := latest.t
-			latest.mu.Unlock()
-			if time.Since(t) < time.Since(sources.updated) {
-				watchLog("WatchService").WithField(
-					"latest", time.Since(t),
-				).WithField(
-					"received", time.Since(sources.updated),
-				).Debugf("Stale source data received: ignore")
-				break
-			}
+			wg.Add(1)
 			go func() {
-				defer func() {
-					latest.mu.Lock()
-					defer latest.mu.Unlock()
-					latest.t = sources.updated
-				}()
-				for _, m := range ws.monitors {
-					value, ok := sources.data.Load(m.c.Value.SourceId)
-					if ok {
-						records, ok := value.(records)[m.c.Value.RecordId]
-						if ok {
-							m.push(records)
-						}
-					}
+				defer wg.Done()
+				pushMu.Lock()
+				defer pushMu.Unlock()
+				if !order.apply(sources.seq) {
+					watchLog("WatchService").WithField(
+						"applied", order.applied,
+					).WithField(
+						"received", sources.seq,
+					).Debugf("Stale source data received: ignore")
+					return
+				}
+				ws.pushMonitors(sources.data)
+				if err := ws.pushMetrics(ctx); err != nil {
+					watchLog("WatchService").WithError(err).Warn("Metrics push failure")
+				}
+				if err := ws.writeTextfile(); err != nil {
+					watchLog("WatchService").WithError(err).Warn("Metrics textfile failure")
 				}
 			}()
 		}
 	}
 }
 
+// batchOrder orders the source batches pulled by Start: the batches are
+// numbered as dispatched and one is applied only if dispatched after the
+// last one applied, whatever the clock does meanwhile. The batches are
+// numbered by the Start loop and applied under its push lock, one at a time,
+// so an older batch never completes its push after a newer one.
+type batchOrder struct {
+	dispatched uint64
+	applied    uint64
+}
+
+// next returns the sequence number of a batch being dispatched.
+func (o *batchOrder) next() uint64 {
+	o.dispatched++
+	return o.dispatched
+}
+
+// apply reports whether the batch seq is newer than the last one applied,
+// making it the last one applied if so.
+func (o *batchOrder) apply(seq uint64) bool {
+	if seq <= o.applied {
+		return false
+	}
+	o.applied = seq
+	return true
+}
+
+// RunOnce pulls all sources once and pushes their records to the monitors,
+// then the metrics to the Pushgateway, the OTLP endpoint and the textfile
+// if configured.
+func (ws *WatchService) RunOnce(ctx context.Context) error {
+	data := ws.pullSources(ctx, nil)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ws.pushMonitors(data)
+	if err := ws.pushMetrics(ctx); err != nil {
+		return err
+	}
+	if err := ws.flushOTel(ctx); err != nil {
+		return err
+	}
+	return ws.writeTextfile()
+}
+
+// pushMonitors pushes the pulled records to the monitors reading them,
+// the monitors of a failed source are pushed no records and are down.
+func (ws *WatchService) pushMonitors(data *sync.Map) {
+	for _, m := range ws.monitors {
+		var (
+			rr []record
+			up bool
+		)
+		if value, ok := data.Load(m.c.Value.SourceId); ok {
+			rr, up = value.(records)[m.c.Value.RecordId]
+		}
+		warnings, ok := m.safePush(rr)
+		ws.addParseWarnings(m, warnings)
+		if up && ok {
+			ws.monitorUp.WithLabelValues(m.c.Id).Set(1)
+		} else {
+			ws.monitorUp.WithLabelValues(m.c.Id).Set(0)
+		}
+		ws.monitorSeries.WithLabelValues(m.c.Id).Set(float64(m.seriesCount()))
+	}
+	ws.broadcastLive()
+	ws.readyOnce.Do(func() { close(ws.ready) })
+}
+
+// OnCycle sets f to be called after every source pull with the source id
+// and its records or its error, for embedding the service. It must be set
+// before the service runs. The pulls being concurrent, so are the calls.
+func (ws *WatchService) OnCycle(f func(sourceId string, recs Records, err error)) {
+	ws.onCycle = f
+}
+
+// Ready returns a channel closed when the first push cycle completes.
+func (ws *WatchService) Ready() <-chan struct{} {
+	return ws.ready
+}
+
+// pullSources pulls all sources concurrently and returns their records
+// keyed by source id. Each pull starts after a random delay within the
+// source jitter. A source depending on another one is pulled after its
+// dependency with the dependency rows as input. A source backing off after
+// repeated failures is not pulled, no source backs off with a nil backoff.
+// Cancelling ctx stops the pulls in flight.
+func (ws *WatchService) pullSources(ctx context.Context, backoff *sourceBackoff) *sync.Map {
+	data := &sync.Map{}
+	done := make(map[string]chan struct{}, len(ws.sources))
+	owners := make(map[string]*Source, len(ws.sources))
+	for _, s := range ws.sources {
+		if _, ok := owners[s.c.Id]; !ok {
+			done[s.c.Id] = make(chan struct{})
+			owners[s.c.Id] = s
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(ws.sources))
+	for _, source := range ws.sources {
+		go func(s *Source, delay time.Duration) {
+			defer wg.Done()
+			if owners[s.c.Id] == s {
+				defer close(done[s.c.Id])
+			}
+			if backoff.skip(s.c.Id) {
+				watchLog("WatchService").WithField("source", s.c.Id).Debug("Source backing off: skip")
+				return
+			}
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+
+			var rows []record
+			if dep := s.c.DependsOn; dep.SourceId != "" {
+				if ch, ok := done[dep.SourceId]; ok {
+					<-ch
+				}
+				value, ok := data.Load(dep.SourceId)
+				if !ok {
+					watchLog("WatchService").WithField("source", s.c.Id).Warnf("Source dependency %q failure", dep.SourceId)
+					return
+				}
+				rows = value.(records)[dep.RecordId]
+			}
+
+			start := time.Now()
+			records, err := s.safePull(ctx, rows)
+			ws.setSourceStatus(s, start, err)
+			if ws.onCycle != nil {
+				ws.onCycle(s.c.Id, records, err)
+			}
+			failures, delay := backoff.done(s.c.Id, err, ws.jitter)
+			if err != nil {
+				entry := watchLog("WatchService").WithError(err).WithField("source", s.c.Id)
+				if delay > 0 {
+					entry = entry.WithField("failures", failures).WithField("backoff", delay)
+				}
+				if backoff.quiet(failures) {
+					entry.Debug("Source refresh failure")
+				} else {
+					entry.Warn("Source refresh failure")
+				}
+			} else {
+				data.Store(s.c.Id, records)
+				ws.sourceLastSuccess.WithLabelValues(s.c.Id).SetToCurrentTime()
+			}
+		}(source, ws.jitter(source.c.Jitter))
+	}
+	wg.Wait()
+	return data
+}
+
 func (g *gaugeMetric) Write(monitor *Monitor, m metric) error {
-	monitor.gauge.WithLabelValues(m.labels...).Set(m.value)
+	labels := monitor.gaugeLabels(m.labels)
+	monitor.gauge.WithLabelValues(labels...).Set(m.value)
+	if monitor.timestamps != nil {
+		monitor.timestamps.set(labels, m.timestamp)
+	}
 	watchLog("gaugeMetric").WithField("metric", monitor.c.Id).Debugf("Written: %v %f", m.labels, m.value)
 	return nil
 }
 
-func (m *Monitor) push(rr []record) {
-	for _, r := range rr {
-		m.metric.Write(m, r.value(m.c.Value))
+func (g *gaugeMetric) Delete(monitor *Monitor, labels []string) bool {
+	labels = monitor.gaugeLabels(labels)
+	deleted := monitor.gauge.DeleteLabelValues(labels...)
+	if monitor.timestamps != nil {
+		monitor.timestamps.set(labels, time.Time{})
 	}
+	watchLog("gaugeMetric").WithField("metric", monitor.c.Id).Debugf("Deleted: %v %t", labels, deleted)
+	return deleted
 }
 
-func (s *Source) pull() (records, error) {
-	if s.command == nil {
-		return nil, fmt.Errorf("source: undefined command")
+func newTimestampCollector(gauge *prom.GaugeVec, labelNames []string) *timestampCollector {
+	return &timestampCollector{
+		GaugeVec:   gauge,
+		labelNames: labelNames,
+		timestamps: map[string]time.Time{},
 	}
-	output, err := s.command.Execute(s)
-	if err != nil {
-		return nil, err
+}
+
+// set records the sample time of the gauge with the label values, a zero
+// time removes it.
+func (c *timestampCollector) set(labels []string, t time.Time) {
+	key := seriesKey(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.IsZero() {
+		delete(c.timestamps, key)
+	} else {
+		c.timestamps[key] = t
 	}
-	res, err := s.parser.Parse(s, strings.NewReader(string(output)))
-	if err != nil {
-		return nil, err
+}
+
+// Collect collects the gauges, each with its sample time if known.
+func (c *timestampCollector) Collect(ch chan<- prom.Metric) {
+	metrics := make(chan prom.Metric)
+	go func() {
+		c.GaugeVec.Collect(metrics)
+		close(metrics)
+	}()
+	for m := range metrics {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			ch <- m
+			continue
+		}
+		values := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			values[l.GetName()] = l.GetValue()
+		}
+		labels := make([]string, len(c.labelNames))
+		for i, name := range c.labelNames {
+			labels[i] = values[name]
+		}
+
+		c.mu.Lock()
+		t, ok := c.timestamps[seriesKey(labels)]
+		c.mu.Unlock()
+		if ok {
+			m = prom.NewMetricWithTimestamp(t, m)
+		}
+		ch <- m
 	}
-	watchLog("Source").Debugf("Parsed records: %+v", res)
-	return res, nil
 }
 
-func (*shellCommand) Execute(s *Source) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), s.c.Timeout)
-	defer cancel()
+// seriesCount returns the number of label sets written.
+func (m *Monitor) seriesCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.series)
+}
 
-	res, err := exec.CommandContext(ctx, "sh", "-c", s.c.Command).CombinedOutput()
-	if err != nil {
-		watchLog("shellCommand").Debugf("%s", res)
-		return nil, err
+func (m *Monitor) push(rr []record) map[string]int {
+	if m.metric == nil {
+		return nil
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values := make([]metric, len(rr))
+	omitted := make([]bool, len(rr))
+	warnings := map[string]int{}
+	for i, r := range rr {
+		v, ok := r.value(m.c.Value)
+		values[i], omitted[i] = v, !ok && m.c.Value.OmitMissing
+		for _, reason := range r.warnings(m.c.Value, ok) {
+			warnings[reason]++
+		}
+	}
+	if m.c.Value.Aggregate != "" {
+		values, omitted = m.aggregate(values, omitted)
+	}
+	if m.series == nil {
+		m.series = map[string][]string{}
+	}
+	kept := m.keptSeries(values, omitted)
+	written := map[string]bool{}
+	dropped := 0
+	for i, v := range values {
+		key := seriesKey(v.labels)
+		if omitted[i] || (kept != nil && !kept[key]) {
+			m.metric.Delete(m, v.labels)
+			delete(m.series, key)
+			continue
+		}
+		if _, ok := m.series[key]; !ok && m.maxCardinality > 0 && len(m.series) >= m.maxCardinality {
+			dropped++
+			continue
+		}
+		m.series[key] = v.labels
+		written[key] = true
+		if m.c.Value.Rate {
+			var ok bool
+			if v, ok = m.rate(key, v); !ok {
+				continue
+			}
+		}
+		m.metric.Write(m, v)
+	}
+	if dropped > 0 && !m.capped {
+		watchLog("Monitor").WithField("monitor", m.c.Id).Warnf("Series over maxCardinality %d, %d label sets not written", m.maxCardinality, dropped)
+	}
+	m.capped = dropped > 0
+	m.pushNoData(written)
+	return warnings
+}
 
-	watchLog("shellCommand").Tracef("%s", res)
-	return res, nil
+// aggregate reduces the values not omitted to a single one, timed by the
+// latest of their timestamps. Without values, avg, min and max have no
+// value to write.
+func (m *Monitor) aggregate(values []metric, omitted []bool) ([]metric, []bool) {
+	var res metric
+	n := 0
+	for i, v := range values {
+		if omitted[i] {
+			continue
+		}
+		switch m.c.Value.Aggregate {
+		case "sum", "avg":
+			res.value += v.value
+		case "min":
+			if n == 0 || v.value < res.value {
+				res.value = v.value
+			}
+		case "max":
+			if n == 0 || v.value > res.value {
+				res.value = v.value
+			}
+		}
+		if v.timestamp.After(res.timestamp) {
+			res.timestamp = v.timestamp
+		}
+		n++
+	}
+	switch m.c.Value.Aggregate {
+	case "count":
+		res.value = float64(n)
+	case "avg":
+		if n > 0 {
+			res.value /= float64(n)
+		}
+	}
+	if n == 0 && m.c.Value.Aggregate != "sum" && m.c.Value.Aggregate != "count" {
+		return nil, nil
+	}
+	return []metric{res}, []bool{false}
 }
 
-func (*csvParser) Parse(s *Source, r io.Reader) (records, error) {
-	csvr := csv.NewReader(r)
-	csvr.Comma = ':'
-	csvr.TrimLeadingSpace = true
+// rate turns the value into its per-second change since the previous
+// sample of the series, timed by the value timestamp or the push time.
+// It returns false for the first sample and on a counter reset. It is
+// called by push with m.mu held, the previous samples are shared by the
+// overlapping pushes.
+func (m *Monitor) rate(key string, v metric) (metric, bool) {
+	t := v.timestamp
+	if t.IsZero() {
+		if m.now != nil {
+			t = m.now()
+		} else {
+			t = time.Now()
+		}
+	}
+	if m.rates == nil {
+		m.rates = map[string]rateSample{}
+	}
+	prev, ok := m.rates[key]
+	m.rates[key] = rateSample{v.value, t}
+	elapsed := t.Sub(prev.time).Seconds()
+	if !ok || v.value < prev.value || elapsed <= 0 {
+		return v, false
+	}
+	v.value = (v.value - prev.value) / elapsed
+	return v, true
+}
 
-	data, err := csvr.ReadAll()
-	if err != nil {
-		return nil, err
+// pushNoData applies the monitor noDataPolicy to the series previously
+// written and missing from the last push: 'keep' leaves their values,
+// 'zero' sets them to 0 and 'delete' removes them. It is called by push
+// with m.mu held.
+func (m *Monitor) pushNoData(written map[string]bool) {
+	var missing []string
+	for key := range m.series {
+		if !written[key] {
+			missing = append(missing, key)
+		}
 	}
-	watchLog("csvParser").Debugf("Parsing data: %+v", data)
-	res := make(records, len(s.c.Output.Records))
-	for i := 0; i < len(s.c.Output.Records); i++ {
-		r := s.c.Output.Records[i]
-		res[r.Id] = table(data).zip(r.Header, r.FirstLineIsHeader)
+	sort.Strings(missing)
+	for _, key := range missing {
+		labels := m.series[key]
+		switch m.c.NoDataPolicy {
+		case "zero":
+			m.metric.Write(m, metric{labels: labels})
+		case "delete":
+			m.metric.Delete(m, labels)
+			delete(m.series, key)
+		}
+	}
+}
+
+// keptSeries returns the label sets within the monitor maxSeries, taking
+// the first ones in label order so the same series are kept every cycle.
+// It returns nil when there is no cap.
+func (m *Monitor) keptSeries(values []metric, omitted []bool) map[string]bool {
+	if m.maxSeries <= 0 {
+		return nil
+	}
+	keys := []string{}
+	seen := map[string]bool{}
+	for i, v := range values {
+		key := seriesKey(v.labels)
+		if !omitted[i] && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) <= m.maxSeries {
+		return seen
+	}
+	sort.Strings(keys)
+	kept := make(map[string]bool, m.maxSeries)
+	for _, key := range keys[:m.maxSeries] {
+		kept[key] = true
+	}
+	watchLog("Monitor").WithField("monitor", m.c.Id).Debugf("Dropped %d series over maxSeries %d", len(keys)-m.maxSeries, m.maxSeries)
+	return kept
+}
+
+// seriesKey identifies a label set.
+func seriesKey(labels []string) string {
+	return strings.Join(labels, "\xff")
+}
+
+// safePull is pull recovering from a panic, returned as the pull error so
+// one broken source can't take the service down.
+func (s *Source) safePull(ctx context.Context, rows []record) (res records, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			watchLog("Source").WithField("source", s.c.Id).WithField("stack", string(debug.Stack())).Errorf("Pull panic: %v", r)
+			res, err = nil, fmt.Errorf("source: panic: %v", r)
+		}
+	}()
+	return s.pull(ctx, rows)
+}
+
+// safePush is push recovering from a panic, ok is false when it did.
+func (m *Monitor) safePush(rr []record) (warnings map[string]int, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			watchLog("Monitor").WithField("monitor", m.c.Id).WithField("stack", string(debug.Stack())).Errorf("Push panic: %v", r)
+			warnings, ok = nil, false
+		}
+	}()
+	return m.push(rr), true
+}
+
+// pull runs the source command and parses its output. With several
+// commands, each output is parsed separately and the records are merged
+// by record id in the command order.
+func (s *Source) pull(ctx context.Context, rows []record) (records, error) {
+	if s.command == nil {
+		return nil, fmt.Errorf("source: undefined command")
+	}
+	if len(s.c.Commands) == 0 {
+		return s.pullCommand(ctx, rows)
+	}
+	res := records{}
+	for _, command := range s.c.Commands {
+		rs := *s
+		rs.c.Command = command
+		rr, err := rs.pullCommand(ctx, rows)
+		if err != nil {
+			return nil, err
+		}
+		for id, r := range rr {
+			res[id] = append(res[id], r...)
+		}
 	}
 	return res, nil
 }
 
-func (p *htmlqueryParser) Parse(s *Source, r io.Reader) (records, error) {
-	doc, err := html.Parse(r)
+func (s *Source) pullCommand(ctx context.Context, rows []record) (records, error) {
+	output, err := s.execute(ctx, rows)
 	if err != nil {
-		return nil, err
+		return nil, commandError(err)
 	}
-	res := make(records, len(s.c.Output.Records))
-	for i := 0; i < len(s.c.Output.Records); i++ {
-		r := s.c.Output.Records[i]
-		var t table
-		switch r.ParserOptions["format"] {
-		case "table":
-			t, err = p.parseFormatTable(&r, doc)
-			if err != nil {
-				return nil, fmt.Errorf("htmlqueryParser: %v", err)
-			}
-		default:
-			return nil, fmt.Errorf("htmlqueryParser: invalid parser option 'format': %+v", r.ParserOptions)
-		}
-		res[r.Id] = t.zip(r.Header, r.FirstLineIsHeader)
+	output, err = s.decompress(output)
+	if err != nil {
+		return nil, &pullError{ErrParseFailed, err}
+	}
+	output, err = s.decode(output)
+	if err != nil {
+		return nil, &pullError{ErrParseFailed, err}
+	}
+	output, err = s.transform(ctx, output)
+	if err != nil {
+		return nil, commandError(err)
+	}
+	res, err := s.parse(output)
+	if err != nil {
+		return nil, &pullError{ErrParseFailed, err}
 	}
+	watchLog("Source").Debugf("Parsed records: %+v", res)
 	return res, nil
 }
 
-func (p *htmlqueryParser) parseFormatTable(r *ParserRecordConfig, doc *html.Node) (table, error) {
-	path, ok := r.ParserOptions["path"]
-	if !ok {
-		return nil, fmt.Errorf("invalid parser option 'path': %+v", r.ParserOptions)
+// parse parses the output with the source parser and, with output stages,
+// each stage part with the stage parser, merging the records by id in the
+// stage order.
+func (s *Source) parse(output []byte) (records, error) {
+	if len(s.c.Output.Stages) == 0 {
+		if s.parser == nil {
+			return nil, fmt.Errorf("unknown parser %q", s.c.Output.Parser)
+		}
+		return s.parser.Parse(s, bytes.NewReader(output))
 	}
-	tr := htmlquery.Find(htmlquery.FindOne(doc, path), "/tr[td]")
-	watchLog("htmlqueryParser").Debugf("Parsing data: %+v", tr)
-	res := make(table, len(tr))
-	for i, r := range tr {
-		td := htmlquery.Find(r, "/td")
-		res[i] = make([]string, len(td))
-		for j, d := range td {
-			res[i][j] = htmlquery.InnerText(d)
+	res := records{}
+	if s.parser != nil {
+		rr, err := s.parser.Parse(s, bytes.NewReader(output))
+		if err != nil {
+			return nil, err
+		}
+		for id, r := range rr {
+			res[id] = append(res[id], r...)
+		}
+	}
+	for i, st := range s.c.Output.Stages {
+		if s.stages[i] == nil {
+			return nil, fmt.Errorf("stage %d: unknown parser %q", i, st.Parser)
+		}
+		part, err := st.part(output)
+		if err != nil {
+			return nil, fmt.Errorf("stage %d: %v", i, err)
+		}
+		rs := *s
+		rs.c.Output = SourceOutputConfig{Parser: st.Parser, Records: st.Records}
+		rr, err := s.stages[i].Parse(&rs, bytes.NewReader(part))
+		if err != nil {
+			return nil, fmt.Errorf("stage %d: %v", i, err)
+		}
+		for id, r := range rr {
+			res[id] = append(res[id], r...)
 		}
 	}
 	return res, nil
 }
 
-func (t table) zip(header []string, skipFirstLine bool) []record {
-	res := make([]record, len(t))
-	for i, r := range t {
-		res[i] = make(record)
-		for j := 0; j < len(header); j++ {
-			res[i][header[j]] = r[j]
+// part returns the part of the output the stage parses.
+func (st OutputStageConfig) part(output []byte) ([]byte, error) {
+	if st.Offset > 0 {
+		if st.Offset > len(output) {
+			st.Offset = len(output)
 		}
+		output = output[st.Offset:]
 	}
-	if skipFirstLine {
-		res = res[1:]
+	if st.Length > 0 && st.Length < len(output) {
+		output = output[:st.Length]
 	}
-	return res
+	if st.Start != "" {
+		i := bytes.Index(output, []byte(st.Start))
+		if i < 0 {
+			return nil, fmt.Errorf("start marker %q not found", st.Start)
+		}
+		output = output[i+len(st.Start):]
+		if nl := bytes.IndexByte(output, '\n'); nl >= 0 {
+			output = output[nl+1:]
+		} else {
+			output = nil
+		}
+	}
+	if st.End != "" {
+		if i := bytes.Index(output, []byte(st.End)); i >= 0 {
+			output = output[:i]
+		}
+	}
+	return output, nil
 }
 
-func (r record) value(c MonitorValueConfig) metric {
-	v, ok := r[c.Header]
-	var val float64
-	if ok {
-		fmt.Sscanf(v, c.Format, &val)
+// execute runs the source command. For a source depending on another
+// one, the command is a template executed once per dependency row and
+// the outputs are concatenated. The row values are shell quoted, read
+// from a device they are never run as commands.
+func (s *Source) execute(ctx context.Context, rows []record) ([]byte, error) {
+	if s.c.DependsOn.SourceId == "" {
+		return s.command.Execute(ctx, s)
 	}
-	ll := make([]string, len(c.Labels))
-	for i, k := range c.Labels {
-		v, ok = r[k.Header]
-		if ok {
-			if k.Format != "" {
-				fmt.Sscanf(v, k.Format, &ll[i])
-			} else {
-				ll[i] = v
-			}
+	tmpl, err := template.New(s.c.Id).Option("missingkey=error").Parse(s.c.Command)
+	if err != nil {
+		return nil, fmt.Errorf("source: invalid command template: %v", err)
+	}
+	var res []byte
+	for _, row := range rows {
+		quoted := make(record, len(row))
+		for k, v := range row {
+			quoted[k] = shellQuote(v)
+		}
+		var command strings.Builder
+		if err := tmpl.Execute(&command, quoted); err != nil {
+			return nil, fmt.Errorf("source: invalid command template: %v", err)
+		}
+		rs := *s
+		rs.c.Command = command.String()
+		output, err := s.command.Execute(ctx, &rs)
+		if err != nil {
+			return nil, err
 		}
+		res = append(res, output...)
+	}
+	return res, nil
+}
+
+// shellQuote quotes s as a single shell word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (s *Source) decompress(output []byte) ([]byte, error) {
+	var (
+		r   io.Reader
+		err error
+	)
+	switch s.c.Decompress {
+	case "", "none":
+		return output, nil
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(output))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(output))
+	default:
+		return nil, fmt.Errorf("source: invalid decompress method: %s", s.c.Decompress)
+	}
+	if err == nil {
+		output, err = io.ReadAll(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("source: malformed %s data: %v", s.c.Decompress, err)
+	}
+	return output, nil
+}
+
+// decode transcodes the output from the source encoding to UTF-8, the
+// encoding names are the ones of the WHATWG Encoding Standard.
+func (s *Source) decode(output []byte) ([]byte, error) {
+	if s.c.Encoding == "" {
+		return output, nil
+	}
+	enc, err := htmlindex.Get(s.c.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("source: invalid encoding: %s", s.c.Encoding)
+	}
+	output, err = enc.NewDecoder().Bytes(output)
+	if err != nil {
+		return nil, fmt.Errorf("source: malformed %s data: %v", s.c.Encoding, err)
+	}
+	return output, nil
+}
+
+// transform pipes the output through the source transform shell command,
+// e.g. jq, within the source timeout.
+func (s *Source) transform(ctx context.Context, output []byte) ([]byte, error) {
+	if s.c.Transform == "" {
+		return output, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.c.Timeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var out, stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", s.c.Transform)
+	cmd.Stdin = bytes.NewReader(output)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	setProcessGroup(cmd)
+	if err := setCredential(cmd, s); err != nil {
+		return nil, fmt.Errorf("source: transform: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("source: transform: %w", err)
+	}
+	stop := killOnCancel(ctx, cmd)
+	err := cmd.Wait()
+	stop()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("source: transform: %w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("source: transform: %w", err)
+	}
+
+	watchLog("Source").Tracef("Transformed output: %s", out.Bytes())
+	return out.Bytes(), nil
+}
+
+// Execute runs the command with the source timeout. On timeout or
+// cancellation the command is killed with the processes it spawned.
+func (*shellCommand) Execute(ctx context.Context, s *Source) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.c.Timeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", s.c.Command)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	setProcessGroup(cmd)
+	if err := setCredential(cmd, s); err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	stop := killOnCancel(ctx, cmd)
+	err := cmd.Wait()
+	stop()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	res := out.Bytes()
+	if err != nil {
+		watchLog("shellCommand").Debugf("%s", res)
+		return nil, err
+	}
+
+	watchLog("shellCommand").Tracef("%s", res)
+	return res, nil
+}
+
+// killOnCancel kills the started command when ctx is done before stop is
+// called.
+func killOnCancel(ctx context.Context, cmd *exec.Cmd) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (*fileCommand) Execute(ctx context.Context, s *Source) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.c.Timeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		res []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := os.ReadFile(s.c.File)
+		done <- result{res, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-done:
+		if r.err != nil {
+			return nil, fmt.Errorf("fileCommand: %w", r.err)
+		}
+		watchLog("fileCommand").Tracef("%s", r.res)
+		return r.res, nil
+	}
+}
+
+func (*tcpCommand) Execute(ctx context.Context, s *Source) ([]byte, error) {
+	u, err := url.Parse(s.c.Addr)
+	if err != nil || u.Scheme != "tcp" {
+		return nil, fmt.Errorf("tcpCommand: invalid address: %s", s.c.Addr)
+	}
+	res, err := dial(ctx, "tcp", u.Host, s)
+	if err != nil {
+		return nil, fmt.Errorf("tcpCommand: %w", err)
+	}
+	watchLog("tcpCommand").Tracef("%s", res)
+	return res, nil
+}
+
+// Execute connects to the unix socket path of a unix:///path.sock address.
+func (*unixCommand) Execute(ctx context.Context, s *Source) ([]byte, error) {
+	u, err := url.Parse(s.c.Addr)
+	if err != nil || u.Scheme != "unix" || u.Path == "" {
+		return nil, fmt.Errorf("unixCommand: invalid address: %s", s.c.Addr)
+	}
+	res, err := dial(ctx, "unix", u.Path, s)
+	if err != nil {
+		return nil, fmt.Errorf("unixCommand: %w", err)
+	}
+	watchLog("unixCommand").Tracef("%s", res)
+	return res, nil
+}
+
+// Execute requests the http(s):// address with the source method, GET by
+// default, and body, after the source steps. The requests share a cookie
+// jar for the pull. Environment variables are expanded in the bodies so
+// credentials can stay out of the config.
+func (*httpCommand) Execute(ctx context.Context, s *Source) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.c.Timeout)
+	defer cancel()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, fmt.Errorf("httpCommand: %w", err)
+	}
+	transport, err := httpTransport(s)
+	if err != nil {
+		return nil, fmt.Errorf("httpCommand: %w", err)
+	}
+	client := &http.Client{Jar: jar, Transport: transport}
+	for i, step := range s.c.Steps {
+		if _, err := httpRequest(ctx, client, step); err != nil {
+			return nil, fmt.Errorf("httpCommand: step %d: %w", i, err)
+		}
+	}
+	res, err := httpRequest(ctx, client, HTTPStepConfig{
+		Addr:        s.c.Addr,
+		Method:      s.c.Method,
+		Body:        s.c.Body,
+		ContentType: s.c.ContentType,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("httpCommand: %w", err)
+	}
+	watchLog("httpCommand").Tracef("%s", res)
+	return res, nil
+}
+
+// httpTransport returns the transport verifying the server certificate
+// as set by the source, nil for the default one.
+func httpTransport(s *Source) (http.RoundTripper, error) {
+	if !s.c.InsecureSkipVerify && s.c.CACertFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: s.c.InsecureSkipVerify}
+	if s.c.CACertFile != "" {
+		pem, err := os.ReadFile(s.c.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificate found", s.c.CACertFile)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return transport, nil
+}
+
+var envBraced = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// expandEnvBraced replaces the ${VAR} references of s by the environment
+// values, the other $ are left as is, e.g. in a query or a password.
+func expandEnvBraced(s string) string {
+	return envBraced.ReplaceAllStringFunc(s, func(ref string) string {
+		return os.Getenv(ref[2 : len(ref)-1])
+	})
+}
+
+func httpRequest(ctx context.Context, client *http.Client, step HTTPStepConfig) ([]byte, error) {
+	method := step.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if step.Body != "" {
+		body = strings.NewReader(expandEnvBraced(step.Body))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, step.Addr, body)
+	if err != nil {
+		return nil, err
+	}
+	if step.ContentType != "" {
+		req.Header.Set("Content-Type", step.ContentType)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// dial connects to the address, writes the source request and reads the
+// response until the delimiter, EOF or the timeout. The source timeout
+// bounds both dialing and the whole exchange, cancelling ctx aborts it.
+func dial(ctx context.Context, network, address string, s *Source) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.c.Timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	if s.c.Request != "" {
+		if _, err := io.WriteString(conn, s.c.Request); err != nil {
+			return nil, err
+		}
+	}
+
+	var res []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		res = append(res, buf[:n]...)
+		if s.c.Delimiter != "" {
+			if i := bytes.Index(res, []byte(s.c.Delimiter)); i >= 0 {
+				return res[:i], nil
+			}
+		}
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && len(res) > 0 && ctx.Err() != context.Canceled {
+				return res, nil
+			}
+			return nil, err
+		}
+	}
+}
+
+// Execute starts the long-running command on first call and then returns
+// the output lines accumulated since the previous call. The command is
+// restarted on the next call after it exits. The command is killed when
+// the ctx of the call starting it is cancelled.
+func (c *streamCommand) Execute(ctx context.Context, s *Source) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.started && c.err == nil {
+		if err := c.start(ctx, s); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.buf.Len() == 0 && c.err != nil {
+		err := c.err
+		c.err = nil
+		return nil, err
+	}
+
+	res := make([]byte, c.buf.Len())
+	copy(res, c.buf.Bytes())
+	c.buf.Reset()
+
+	watchLog("streamCommand").Tracef("%s", res)
+	return res, nil
+}
+
+func (c *streamCommand) start(ctx context.Context, s *Source) error {
+	cmd := exec.Command("sh", "-c", s.c.Command)
+	setProcessGroup(cmd)
+	if err := setCredential(cmd, s); err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	c.started = true
+	stop := killOnCancel(ctx, cmd)
+
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			c.mu.Lock()
+			c.buf.Write(scanner.Bytes())
+			c.buf.WriteByte('\n')
+			c.mu.Unlock()
+		}
+		err := cmd.Wait()
+		stop()
+		if err == nil {
+			err = scanner.Err()
+		}
+		if err == nil {
+			err = fmt.Errorf("streamCommand: process exited")
+		}
+		watchLog("streamCommand").WithError(err).WithField("source", s.c.Id).Debug("Stream closed")
+
+		c.mu.Lock()
+		c.started = false
+		c.err = err
+		c.mu.Unlock()
+	}()
+	return nil
+}
+
+func (p *csvParser) Parse(s *Source, r io.Reader) (records, error) {
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	res := make(records, len(s.c.Output.Records))
+	for i := 0; i < len(s.c.Output.Records); i++ {
+		r := s.c.Output.Records[i]
+		csvr, err := p.newReader(&r, input)
+		if err != nil {
+			return nil, fmt.Errorf("csvParser: %v", err)
+		}
+		data, err := csvr.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		watchLog("csvParser").Debugf("Parsing data: %+v", data)
+		if r.HeaderPattern != "" {
+			re, err := regexp.Compile(r.HeaderPattern)
+			if err != nil {
+				return nil, fmt.Errorf("csvParser: invalid headerPattern: %v", err)
+			}
+			res[r.Id] = table(data).zipMapped(table(data).matchColumns(re), true)
+		} else if v, ok := r.ParserOptions["columns"]; ok {
+			columns, err := parseColumns(v)
+			if err != nil {
+				return nil, fmt.Errorf("csvParser: invalid parser option 'columns': %v", err)
+			}
+			res[r.Id] = table(data).zipMapped(columns, r.FirstLineIsHeader)
+		} else {
+			skip, err := skipShortRows(&r)
+			if err != nil {
+				return nil, fmt.Errorf("csvParser: %v", err)
+			}
+			if err := table(data).checkHeader(&r); err != nil {
+				return nil, fmt.Errorf("csvParser: %v", err)
+			}
+			res[r.Id] = table(data).zip(r.Header, r.FirstLineIsHeader, skip)
+		}
+		if v, ok := r.ParserOptions["filter"]; ok {
+			column, value, err := parseFilter(v)
+			if err != nil {
+				return nil, fmt.Errorf("csvParser: invalid parser option 'filter': %v", err)
+			}
+			res[r.Id] = filterRecords(res[r.Id], column, value)
+		}
+	}
+	return res, nil
+}
+
+// parseFilter parses a "column=value" record filter.
+func parseFilter(v string) (column, value string, err error) {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+		return "", "", fmt.Errorf("expected column=value, got %q", v)
+	}
+	return strings.TrimSpace(kv[0]), kv[1], nil
+}
+
+// filterRecords keeps the records whose column is value, so records of
+// one input can be split by a discriminator column.
+func filterRecords(rr []record, column, value string) []record {
+	res := make([]record, 0, len(rr))
+	for _, rec := range rr {
+		if rec[column] == value {
+			res = append(res, rec)
+		}
+	}
+	return res
+}
+
+// parseColumns parses a "name=index,..." mapping of header names to
+// column indices.
+func parseColumns(v string) (map[string]int, error) {
+	res := map[string]int{}
+	for _, c := range strings.Split(v, ",") {
+		kv := strings.SplitN(c, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected name=index, got %q", c)
+		}
+		name := strings.TrimSpace(kv[0])
+		i, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid column index for %q: %q", name, kv[1])
+		}
+		res[name] = i
+	}
+	return res, nil
+}
+
+// rowsReader reads all the rows of a parser input.
+type rowsReader interface {
+	ReadAll() ([][]string, error)
+}
+
+// newReader makes a CSV reader of the input lines. With the 'comment'
+// option, lines starting with the comment character, after any leading
+// spaces, are skipped. With the 'skipBlank' option, so are lines of
+// spaces only. With the 'fixedWidths' option, the lines are split into
+// fixed-width columns instead, and with the 'format: split' option, at the
+// matches of the 'splitPattern' regexp.
+func (p *csvParser) newReader(r *ParserRecordConfig, input []byte) (rowsReader, error) {
+	var comment string
+	if v, ok := r.ParserOptions["comment"]; ok {
+		if len([]rune(v)) != 1 {
+			return nil, fmt.Errorf("invalid parser option 'comment': %+v", r.ParserOptions)
+		}
+		comment = v
+	}
+	var skipBlank bool
+	if v, ok := r.ParserOptions["skipBlank"]; ok {
+		var err error
+		skipBlank, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parser option 'skipBlank': %+v", r.ParserOptions)
+		}
+	}
+	if comment != "" || skipBlank {
+		input = filterLines(input, comment, skipBlank)
+	}
+
+	if v, ok := r.ParserOptions["fixedWidths"]; ok {
+		widths, err := parseWidths(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parser option 'fixedWidths': %v", err)
+		}
+		return &fixedWidthReader{input: input, widths: widths}, nil
+	}
+	switch r.ParserOptions["format"] {
+	case "", "csv":
+	case "split":
+		pattern := DefaultSplitPattern
+		if v, ok := r.ParserOptions["splitPattern"]; ok {
+			pattern = v
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parser option 'splitPattern': %v", err)
+		}
+		return &splitReader{input: input, re: re, fields: len(r.Header)}, nil
+	default:
+		return nil, fmt.Errorf("invalid parser option 'format': %q", r.ParserOptions["format"])
+	}
+
+	csvr := csv.NewReader(bytes.NewReader(input))
+	csvr.Comma = ':'
+	csvr.TrimLeadingSpace = true
+
+	if v, ok := r.ParserOptions["lazyQuotes"]; ok {
+		lazyQuotes, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parser option 'lazyQuotes': %+v", r.ParserOptions)
+		}
+		csvr.LazyQuotes = lazyQuotes
+	}
+	if v, ok := r.ParserOptions["fieldsPerRecord"]; ok {
+		fieldsPerRecord, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parser option 'fieldsPerRecord': %+v", r.ParserOptions)
+		}
+		csvr.FieldsPerRecord = fieldsPerRecord
+	}
+	return csvr, nil
+}
+
+// parseWidths parses a "width,..." list of column widths.
+func parseWidths(v string) ([]int, error) {
+	var res []int
+	for _, w := range strings.Split(v, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil || i <= 0 {
+			return nil, fmt.Errorf("invalid column width %q", w)
+		}
+		res = append(res, i)
+	}
+	return res, nil
+}
+
+// fixedWidthReader splits every non-empty line into columns of the widths
+// in characters, the last column extending to the end of the line. The
+// columns are trimmed.
+type fixedWidthReader struct {
+	input  []byte
+	widths []int
+}
+
+func (f *fixedWidthReader) ReadAll() ([][]string, error) {
+	var res [][]string
+	for _, line := range strings.Split(string(f.input), "\n") {
+		runes := []rune(strings.TrimRight(line, "\r"))
+		if len(strings.TrimSpace(string(runes))) == 0 {
+			continue
+		}
+		row := make([]string, 0, len(f.widths))
+		start := 0
+		for i, w := range f.widths {
+			if start >= len(runes) {
+				break
+			}
+			end := start + w
+			if end > len(runes) || i == len(f.widths)-1 {
+				end = len(runes)
+			}
+			row = append(row, strings.TrimSpace(string(runes[start:end])))
+			start = end
+		}
+		res = append(res, row)
+	}
+	return res, nil
+}
+
+// DefaultSplitPattern splits the lines at runs of spaces, when the csv
+// parser 'format: split' option sets no 'splitPattern'.
+const DefaultSplitPattern = `\s+`
+
+// splitReader splits every non-empty line, trimmed, at the matches of re.
+// With a number of fields, the last one extends to the end of the line, so
+// it may hold separators, e.g. the "Mounted on" column of df.
+type splitReader struct {
+	input  []byte
+	re     *regexp.Regexp
+	fields int
+}
+
+func (s *splitReader) ReadAll() ([][]string, error) {
+	n := s.fields
+	if n == 0 {
+		n = -1
+	}
+	var res [][]string
+	for _, line := range strings.Split(string(s.input), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		res = append(res, s.re.Split(line, n))
+	}
+	return res, nil
+}
+
+// filterLines drops the comment lines and, with skipBlank, the blank lines
+// of the input.
+func filterLines(input []byte, comment string, skipBlank bool) []byte {
+	var res bytes.Buffer
+	for _, line := range bytes.SplitAfter(input, []byte("\n")) {
+		trimmed := bytes.TrimSpace(line)
+		if comment != "" && bytes.HasPrefix(trimmed, []byte(comment)) {
+			continue
+		}
+		if skipBlank && len(trimmed) == 0 {
+			continue
+		}
+		res.Write(line)
+	}
+	return res.Bytes()
+}
+
+// Parse reads the Prometheus text exposition format. Each record takes
+// the samples of the metric family named by the 'metric' parser option
+// (the record id by default), one row per sample with its label values
+// and a 'value' key. A label named value is read as 'exported_value'.
+func (p *promParser) Parse(s *Source, r io.Reader) (records, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, fmt.Errorf("promParser: %v", err)
+	}
+	res := make(records, len(s.c.Output.Records))
+	for i := 0; i < len(s.c.Output.Records); i++ {
+		r := s.c.Output.Records[i]
+		name, ok := r.ParserOptions["metric"]
+		if !ok {
+			name = r.Id
+		}
+		rows := []record{}
+		if family, ok := families[name]; ok {
+			for _, m := range family.GetMetric() {
+				var value float64
+				switch family.GetType() {
+				case dto.MetricType_COUNTER:
+					value = m.GetCounter().GetValue()
+				case dto.MetricType_GAUGE:
+					value = m.GetGauge().GetValue()
+				case dto.MetricType_UNTYPED:
+					value = m.GetUntyped().GetValue()
+				default:
+					return nil, fmt.Errorf("promParser: unsupported metric type %s: %s", family.GetType(), name)
+				}
+				row := record{"value": strconv.FormatFloat(value, 'f', -1, 64)}
+				for _, l := range m.GetLabel() {
+					name := l.GetName()
+					if name == "value" {
+						// as Prometheus does on a label conflict
+						name = "exported_value"
+					}
+					row[name] = l.GetValue()
+				}
+				rows = append(rows, row)
+			}
+		}
+		res[r.Id] = rows
+	}
+	return res, nil
+}
+
+func (p *htmlqueryParser) Parse(s *Source, r io.Reader) (records, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	res := make(records, len(s.c.Output.Records))
+	for i := 0; i < len(s.c.Output.Records); i++ {
+		r := s.c.Output.Records[i]
+		var t table
+		switch r.ParserOptions["format"] {
+		case "table":
+			t, err = p.parseFormatTable(&r, doc)
+			if err != nil {
+				return nil, fmt.Errorf("htmlqueryParser: %v", err)
+			}
+		case "list":
+			t, err = p.parseFormatList(&r, doc)
+			if err != nil {
+				return nil, fmt.Errorf("htmlqueryParser: %v", err)
+			}
+		case "css":
+			t, err = p.parseFormatCSS(&r, doc)
+			if err != nil {
+				return nil, fmt.Errorf("htmlqueryParser: %v", err)
+			}
+		default:
+			return nil, fmt.Errorf("htmlqueryParser: invalid parser option 'format': %+v", r.ParserOptions)
+		}
+		skip, err := skipShortRows(&r)
+		if err != nil {
+			return nil, fmt.Errorf("htmlqueryParser: %v", err)
+		}
+		if err := t.checkHeader(&r); err != nil {
+			return nil, fmt.Errorf("htmlqueryParser: %v", err)
+		}
+		res[r.Id] = t.zip(r.Header, r.FirstLineIsHeader, skip)
+	}
+	return res, nil
+}
+
+// parseFormatTable makes a row of every 'tr' with cells of the nodes
+// matched by the 'path' option. The rows of several matches are
+// concatenated, the header line of the matches after the first one is
+// dropped when the first line is the header. A path matching no nodes is
+// an error.
+func (p *htmlqueryParser) parseFormatTable(r *ParserRecordConfig, doc *html.Node) (table, error) {
+	path, ok := r.ParserOptions["path"]
+	if !ok {
+		return nil, fmt.Errorf("invalid parser option 'path': %+v", r.ParserOptions)
+	}
+	nodes, err := htmlquery.QueryAll(doc, path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parser option 'path': %v", err)
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("path matched no nodes: %s", path)
+	}
+	var tr []*html.Node
+	for i, n := range nodes {
+		rows := htmlquery.Find(n, "/tr[td]")
+		if i > 0 && r.FirstLineIsHeader && len(rows) > 0 {
+			rows = rows[1:]
+		}
+		tr = append(tr, rows...)
+	}
+	watchLog("htmlqueryParser").Debugf("Parsing data: %+v", tr)
+	res := make(table, len(tr))
+	for i, r := range tr {
+		td := htmlquery.Find(r, "/td")
+		res[i] = make([]string, len(td))
+		for j, d := range td {
+			res[i][j] = htmlquery.InnerText(d)
+		}
+	}
+	return res, nil
+}
+
+// validate compiles the path and fields of the record parser options.
+func (p *htmlqueryParser) validate(r *ParserRecordConfig) error {
+	path, ok := r.ParserOptions["path"]
+	if !ok {
+		return nil
+	}
+	var fields []string
+	if f, ok := r.ParserOptions["fields"]; ok {
+		fields = strings.Split(f, ",")
+	}
+	switch r.ParserOptions["format"] {
+	case "table", "list":
+		if _, err := xpath.Compile(path); err != nil {
+			return fmt.Errorf("invalid XPath 'path' %q: %v", path, err)
+		}
+		for _, f := range fields {
+			f, _ = splitAttr(strings.TrimSpace(f))
+			if f == "" {
+				continue
+			}
+			if _, err := xpath.Compile(f); err != nil {
+				return fmt.Errorf("invalid XPath 'fields' %q: %v", f, err)
+			}
+		}
+	case "css":
+		if _, err := cascadia.Compile(path); err != nil {
+			return fmt.Errorf("invalid CSS selector 'path' %q: %v", path, err)
+		}
+		for _, f := range fields {
+			f, _ = cssSplitAttr(strings.TrimSpace(f))
+			if f == "" {
+				continue
+			}
+			if _, err := cascadia.Compile(f); err != nil {
+				return fmt.Errorf("invalid CSS selector 'fields' %q: %v", f, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseFormatList makes a row of every node matched by the 'path' option.
+// The 'fields' option lists comma-separated sub-paths, one per column,
+// relative to the matched node. A sub-path ending with '@name' takes the
+// attribute value, otherwise the inner text; an empty sub-path or no
+// 'fields' at all takes the inner text of the node itself.
+func (p *htmlqueryParser) parseFormatList(r *ParserRecordConfig, doc *html.Node) (table, error) {
+	path, ok := r.ParserOptions["path"]
+	if !ok {
+		return nil, fmt.Errorf("invalid parser option 'path': %+v", r.ParserOptions)
+	}
+	fields := []string{""}
+	if f, ok := r.ParserOptions["fields"]; ok {
+		fields = strings.Split(f, ",")
+	}
+	nodes, err := htmlquery.QueryAll(doc, path)
+	if err != nil {
+		return nil, err
+	}
+	watchLog("htmlqueryParser").Debugf("Parsing data: %+v", nodes)
+	res := make(table, len(nodes))
+	for i, n := range nodes {
+		res[i] = make([]string, len(fields))
+		for j, f := range fields {
+			res[i][j], err = listField(n, strings.TrimSpace(f))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// splitAttr splits the trailing '@name' attribute of a list sub-path.
+func splitAttr(path string) (string, string) {
+	if i := strings.LastIndex(path, "@"); i >= 0 && !strings.ContainsAny(path[i:], "/[]") {
+		return strings.TrimSuffix(path[:i], "/"), path[i+1:]
+	}
+	return path, ""
+}
+
+// listField extracts a single column value of a list node.
+func listField(n *html.Node, path string) (string, error) {
+	path, attr := splitAttr(path)
+	if path != "" {
+		var err error
+		n, err = htmlquery.Query(n, path)
+		if err != nil {
+			return "", err
+		}
+		if n == nil {
+			return "", nil
+		}
+	}
+	if attr != "" {
+		return htmlquery.SelectAttr(n, attr), nil
+	}
+	return htmlquery.InnerText(n), nil
+}
+
+// parseFormatCSS makes a row of every node matched by the 'path' CSS
+// selector. Without the 'fields' option, the columns are the inner texts
+// of the row 'td' cells and rows without cells are skipped. The 'fields'
+// option lists comma-separated CSS sub-selectors, one per column, taking
+// the first match inner text or, with a '@name' suffix, its attribute.
+func (p *htmlqueryParser) parseFormatCSS(r *ParserRecordConfig, doc *html.Node) (table, error) {
+	path, ok := r.ParserOptions["path"]
+	if !ok {
+		return nil, fmt.Errorf("invalid parser option 'path': %+v", r.ParserOptions)
+	}
+	sel, err := cascadia.Compile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parser option 'path': %v", err)
+	}
+	cell := cascadia.MustCompile("td")
+
+	nodes := sel.MatchAll(doc)
+	watchLog("htmlqueryParser").Debugf("Parsing data: %+v", nodes)
+	res := make(table, 0, len(nodes))
+	f, ok := r.ParserOptions["fields"]
+	if !ok {
+		for _, n := range nodes {
+			cells := cell.MatchAll(n)
+			if len(cells) == 0 {
+				continue
+			}
+			row := make([]string, len(cells))
+			for j, c := range cells {
+				row[j] = htmlquery.InnerText(c)
+			}
+			res = append(res, row)
+		}
+		return res, nil
+	}
+
+	fields := strings.Split(f, ",")
+	for _, n := range nodes {
+		row := make([]string, len(fields))
+		for j, f := range fields {
+			row[j], err = cssField(n, strings.TrimSpace(f))
+			if err != nil {
+				return nil, fmt.Errorf("invalid parser option 'fields': %v", err)
+			}
+		}
+		res = append(res, row)
+	}
+	return res, nil
+}
+
+// cssSplitAttr splits the trailing '@name' attribute of a CSS sub-selector.
+func cssSplitAttr(selector string) (string, string) {
+	if i := strings.LastIndex(selector, "@"); i >= 0 {
+		return strings.TrimSpace(selector[:i]), selector[i+1:]
+	}
+	return selector, ""
+}
+
+// cssField extracts a single column value of a CSS matched node.
+func cssField(n *html.Node, selector string) (string, error) {
+	selector, attr := cssSplitAttr(selector)
+	if selector != "" {
+		sel, err := cascadia.Compile(selector)
+		if err != nil {
+			return "", err
+		}
+		if n = sel.MatchFirst(n); n == nil {
+			return "", nil
+		}
+	}
+	if attr != "" {
+		return htmlquery.SelectAttr(n, attr), nil
+	}
+	return htmlquery.InnerText(n), nil
+}
+
+// zip maps each row's columns to the header names positionally, up to
+// the shorter of the header and the row. Missing columns of short rows
+// are filled with "" or, with skipShortRows, the whole row is skipped,
+// extra columns of long rows are dropped. Without header names, a
+// skipped first line provides them.
+func (t table) zip(header []string, skipFirstLine, skipShortRows bool) []record {
+	if len(header) == 0 && skipFirstLine && len(t) > 0 {
+		header = t[0]
+	}
+	res := make([]record, 0, len(t))
+	mismatched := 0
+	for i, r := range t {
+		if i == 0 && skipFirstLine {
+			continue
+		}
+		if len(r) != len(header) {
+			mismatched++
+		}
+		if len(r) < len(header) && skipShortRows {
+			continue
+		}
+		n := len(header)
+		if len(r) < n {
+			n = len(r)
+		}
+		rec := make(record, len(header))
+		for j := 0; j < n; j++ {
+			rec[header[j]] = r[j]
+		}
+		for j := n; j < len(header); j++ {
+			rec[header[j]] = ""
+		}
+		res = append(res, rec)
+	}
+	if mismatched > 0 {
+		watchLog("zip").WithField("header", header).Debugf("%d row(s) not matching the header width %d", mismatched, len(header))
+	}
+	return res
+}
+
+// checkHeader compares the first line to the record header when the
+// record header is strict, the cells trimmed of spaces.
+func (t table) checkHeader(r *ParserRecordConfig) error {
+	if !r.StrictHeader || !r.FirstLineIsHeader || len(r.Header) == 0 {
+		return nil
+	}
+	var first []string
+	if len(t) > 0 {
+		first = make([]string, len(t[0]))
+		for i, name := range t[0] {
+			first[i] = strings.TrimSpace(name)
+		}
+	}
+	mismatch := len(first) != len(r.Header)
+	for i := 0; !mismatch && i < len(first); i++ {
+		mismatch = first[i] != r.Header[i]
+	}
+	if mismatch {
+		return fmt.Errorf("record %q: header mismatch: expected %q, got %q", r.Id, r.Header, first)
+	}
+	return nil
+}
+
+func skipShortRows(r *ParserRecordConfig) (bool, error) {
+	v, ok := r.ParserOptions["skipShortRows"]
+	if !ok {
+		return false, nil
+	}
+	res, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid parser option 'skipShortRows': %+v", r.ParserOptions)
+	}
+	return res, nil
+}
+
+// matchColumns maps the names of the first line matching re to their
+// column indices.
+func (t table) matchColumns(re *regexp.Regexp) map[string]int {
+	res := map[string]int{}
+	if len(t) == 0 {
+		return res
+	}
+	for i, name := range t[0] {
+		if re.MatchString(name) {
+			res[name] = i
+		}
+	}
+	return res
+}
+
+// zipMapped is like zip but takes each header's column index from the
+// columns mapping instead of its position in the header.
+func (t table) zipMapped(columns map[string]int, skipFirstLine bool) []record {
+	res := make([]record, 0, len(t))
+	for i, r := range t {
+		if i == 0 && skipFirstLine {
+			continue
+		}
+		rec := make(record)
+		for h, j := range columns {
+			if j < len(r) {
+				rec[h] = r[j]
+			} else {
+				rec[h] = ""
+			}
+		}
+		res = append(res, rec)
+	}
+	return res
+}
+
+// render executes the label template against the record, missing
+// record fields render as "".
+func (r record) render(text string) string {
+	tmpl, err := template.New("label").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		watchLog("record").WithError(err).Debug("Invalid label template")
+		return ""
+	}
+	var res strings.Builder
+	if err := tmpl.Execute(&res, r); err != nil {
+		watchLog("record").WithError(err).Debug("Label template failure")
+		return ""
+	}
+	return res.String()
+}
+
+// parseValue parses a raw value according to the configured value type.
+func parseValue(v string, c MonitorValueConfig) (float64, error) {
+	switch c.ValueType {
+	case "duration":
+		d, err := parseDuration(v)
+		return d.Seconds(), err
+	case "timestamp":
+		t, err := parseTime(v, c.TimeLayout)
+		if err != nil {
+			return 0, err
+		}
+		return float64(t.UnixNano()) / 1e9, nil
+	default:
+		var val float64
+		_, err := fmt.Sscanf(normalizeDecimal(v, c.DecimalSeparator), c.Format, &val)
+		return val, err
+	}
+}
+
+// normalizeDecimal removes the thousands separators of v and makes its
+// decimal separator a dot, e.g. "1.234,56" with the "," separator is
+// "1234.56".
+func normalizeDecimal(v, separator string) string {
+	switch separator {
+	case ",":
+		return strings.ReplaceAll(strings.ReplaceAll(v, ".", ""), ",", ".")
+	case ".":
+		return strings.ReplaceAll(v, ",", "")
+	}
+	return v
+}
+
+// parseTime parses v with the layout, RFC 3339 by default, or as unix
+// seconds with the "unix" layout.
+func parseTime(v, layout string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	switch layout {
+	case "":
+		return time.Parse(time.RFC3339, v)
+	case "unix":
+		sec, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(sec*1e9)), nil
+	default:
+		return time.Parse(layout, v)
+	}
+}
+
+var durationPart = regexp.MustCompile(`(?i)(\d+(?:\.\d+)?)\s*(weeks?|w|days?|d|hours?|hrs?|h|minutes?|mins?|m|seconds?|secs?|s)\b`)
+
+// parseDuration parses Go durations like "1h30m" as well as human ones
+// like "up 5 days, 3 hours", summing every number-unit pair found.
+func parseDuration(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	if d, err := time.ParseDuration(v); err == nil {
+		return d, nil
+	}
+	parts := durationPart.FindAllStringSubmatch(v, -1)
+	if len(parts) == 0 {
+		return 0, fmt.Errorf("invalid duration: %q", v)
+	}
+	var res time.Duration
+	for _, p := range parts {
+		n, err := strconv.ParseFloat(p[1], 64)
+		if err != nil {
+			return 0, err
+		}
+		unit := time.Second
+		switch strings.ToLower(p[2])[0] {
+		case 'w':
+			unit = 7 * 24 * time.Hour
+		case 'd':
+			unit = 24 * time.Hour
+		case 'h':
+			unit = time.Hour
+		case 'm':
+			unit = time.Minute
+		}
+		res += time.Duration(n * float64(unit))
+	}
+	return res, nil
+}
+
+// Parse warning reasons, why a record is not fully read by a monitor.
+const (
+	warningMissingValue = "missing_value"
+	warningUnparseable  = "unparseable"
+	warningMissingLabel = "missing_label"
+)
+
+// warnings returns why the record value, ok as returned by value, and
+// labels are not fully read.
+func (r record) warnings(c MonitorValueConfig, ok bool) []string {
+	var res []string
+	if !ok {
+		if _, found := r[c.Header]; found {
+			res = append(res, warningUnparseable)
+		} else {
+			res = append(res, warningMissingValue)
+		}
+	}
+	for _, l := range c.Labels {
+		if _, found := r[l.Header]; l.Template == "" && !found {
+			res = append(res, warningMissingLabel)
+		}
+	}
+	return res
+}
+
+// value extracts the metric from the record, ok is false when the value
+// header is missing or can't be mapped nor parsed with the configured format.
+func (r record) value(c MonitorValueConfig) (m metric, ok bool) {
+	v, ok := r[c.Header]
+	var val float64
+	if ok {
+		if mapped, found := c.ValueMap[strings.TrimSpace(v)]; found {
+			val = mapped
+		} else {
+			var err error
+			val, err = parseValue(v, c)
+			ok = err == nil
+		}
+	}
+	ll := make([]string, len(c.Labels))
+	for i, k := range c.Labels {
+		if k.Template != "" {
+			ll[i] = r.render(k.Template)
+			continue
+		}
+		v, found := r[k.Header]
+		if found {
+			if k.Format != "" {
+				fmt.Sscanf(v, k.Format, &ll[i])
+			} else {
+				ll[i] = v
+			}
+		}
+	}
+	var ts time.Time
+	if c.TimestampHeader != "" {
+		ts, _ = parseTime(r[c.TimestampHeader], c.TimestampFormat)
 	}
-	return metric{ll, val}
+	return metric{ll, val, ts}, ok
 }
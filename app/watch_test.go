@@ -1,27 +1,49 @@
 package app
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 )
 
 type (
 	testMetric struct {
 		written []metric
+		deleted [][]string
 		err     error
 	}
 
 	testCommand struct {
-		res string
-		err error
+		res      string
+		err      error
+		mu       sync.Mutex
+		executed []time.Time
 	}
 
 	testParser struct {
@@ -35,7 +57,15 @@ func (m *testMetric) Write(monitor *Monitor, value metric) error {
 	return m.err
 }
 
-func (c *testCommand) Execute(source *Source) ([]byte, error) {
+func (m *testMetric) Delete(monitor *Monitor, labels []string) bool {
+	m.deleted = append(m.deleted, labels)
+	return true
+}
+
+func (c *testCommand) Execute(ctx context.Context, source *Source) ([]byte, error) {
+	c.mu.Lock()
+	c.executed = append(c.executed, time.Now())
+	c.mu.Unlock()
 	return []byte(c.res), c.err
 }
 
@@ -78,8 +108,8 @@ func Test_Monitor_push(t *testing.T) {
 			"Check empty value",
 			MonitorValueConfig{},
 			[]metric{
-				{[]string{}, 0},
-				{[]string{}, 0},
+				{labels: []string{}, value: 0},
+				{labels: []string{}, value: 0},
 			},
 		}, {
 			"Check empty value format",
@@ -87,8 +117,8 @@ func Test_Monitor_push(t *testing.T) {
 				Header: "correcteds",
 			},
 			[]metric{
-				{[]string{}, 0},
-				{[]string{}, 0},
+				{labels: []string{}, value: 0},
+				{labels: []string{}, value: 0},
 			},
 		}, {
 			"Check bad value format",
@@ -97,8 +127,8 @@ func Test_Monitor_push(t *testing.T) {
 				Format: "%d",
 			},
 			[]metric{
-				{[]string{}, 0},
-				{[]string{}, 0},
+				{labels: []string{}, value: 0},
+				{labels: []string{}, value: 0},
 			},
 		}, {
 			"Check correct value format",
@@ -107,8 +137,8 @@ func Test_Monitor_push(t *testing.T) {
 				Format: "%f",
 			},
 			[]metric{
-				{[]string{}, 29883},
-				{[]string{}, 29882},
+				{labels: []string{}, value: 29883},
+				{labels: []string{}, value: 29882},
 			},
 		}, {
 			"Check correct value format with labels",
@@ -120,8 +150,22 @@ func Test_Monitor_push(t *testing.T) {
 				},
 			},
 			[]metric{
-				{[]string{"76", "Downstream 4"}, 138},
-				{[]string{"75", "Downstream 3"}, 118},
+				{labels: []string{"76", "Downstream 4"}, value: 138},
+				{labels: []string{"75", "Downstream 3"}, value: 118},
+			},
+		}, {
+			"Check correct value format with labels(template)",
+			MonitorValueConfig{
+				Header: "snr",
+				Format: "%f dB",
+				Labels: []MonitorValueLabelConfig{
+					{Header: "channel", Template: "{{.dcid}}/{{.name}}"},
+					{Header: "missing", Template: "{{.missing}}"},
+				},
+			},
+			[]metric{
+				{labels: []string{"76/Downstream 4", ""}, value: 37.94},
+				{labels: []string{"75/Downstream 3", ""}, value: 38.74},
 			},
 		}, {
 			"Check correct value format with labels(format)",
@@ -133,8 +177,8 @@ func Test_Monitor_push(t *testing.T) {
 				},
 			},
 			[]metric{
-				{[]string{"2.33"}, 256},
-				{[]string{"2.35"}, 256},
+				{labels: []string{"2.33"}, value: 256},
+				{labels: []string{"2.35"}, value: 256},
 			},
 		},
 	}
@@ -161,6 +205,373 @@ func Test_Monitor_push(t *testing.T) {
 	}
 }
 
+func Test_Monitor_push_omitMissing(t *testing.T) {
+	rr := []record{
+		{"name": "Downstream 1", "power": "2.33 dBmV"},
+		{"name": "Downstream 2"},
+		{"name": "Downstream 3", "power": "n/a"},
+	}
+
+	tests := []struct {
+		name        string
+		omitMissing bool
+		wantWritten []metric
+		wantDeleted [][]string
+	}{
+		{
+			"omit off",
+			false,
+			[]metric{
+				{labels: []string{"Downstream 1"}, value: 2.33},
+				{labels: []string{"Downstream 2"}, value: 0},
+				{labels: []string{"Downstream 3"}, value: 0},
+			},
+			nil,
+		}, {
+			"omit on",
+			true,
+			[]metric{
+				{labels: []string{"Downstream 1"}, value: 2.33},
+			},
+			[][]string{
+				{"Downstream 2"},
+				{"Downstream 3"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metric := &testMetric{}
+			m := Monitor{
+				c: MonitorConfig{
+					Value: MonitorValueConfig{
+						Header:      "power",
+						Format:      "%f dBmV",
+						Labels:      []MonitorValueLabelConfig{{Header: "name"}},
+						OmitMissing: tt.omitMissing,
+					},
+				},
+				metric: metric,
+			}
+
+			m.push(rr)
+
+			assert.Equal(t, tt.wantWritten, metric.written)
+			assert.Equal(t, tt.wantDeleted, metric.deleted)
+		})
+	}
+}
+
+func Test_Monitor_push_noDataPolicy(t *testing.T) {
+	first := []record{
+		{"name": "Downstream 1", "power": "1"},
+		{"name": "Downstream 2", "power": "2"},
+	}
+	second := []record{
+		{"name": "Downstream 2", "power": "3"},
+	}
+
+	tests := []struct {
+		policy      string
+		wantWritten []metric
+		wantDeleted [][]string
+	}{
+		{
+			"keep",
+			[]metric{
+				{labels: []string{"Downstream 2"}, value: 3},
+			},
+			nil,
+		}, {
+			"zero",
+			[]metric{
+				{labels: []string{"Downstream 2"}, value: 3},
+				{labels: []string{"Downstream 1"}, value: 0},
+				{labels: []string{"Downstream 1"}, value: 0},
+				{labels: []string{"Downstream 2"}, value: 0},
+			},
+			nil,
+		}, {
+			"delete",
+			[]metric{
+				{labels: []string{"Downstream 2"}, value: 3},
+			},
+			[][]string{
+				{"Downstream 1"},
+				{"Downstream 2"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			m := Monitor{
+				c: MonitorConfig{
+					NoDataPolicy: tt.policy,
+					Value: MonitorValueConfig{
+						Header: "power",
+						Format: "%f",
+						Labels: []MonitorValueLabelConfig{{Header: "name"}},
+					},
+				},
+				metric: &testMetric{},
+			}
+			m.push(first)
+
+			metric := &testMetric{}
+			m.metric = metric
+			m.push(second)
+			m.push(nil)
+
+			assert.Equal(t, tt.wantWritten, metric.written)
+			assert.Equal(t, tt.wantDeleted, metric.deleted)
+		})
+	}
+}
+
+func Test_Monitor_push_rate(t *testing.T) {
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	tm := &testMetric{}
+	m := Monitor{
+		c: MonitorConfig{
+			Value: MonitorValueConfig{
+				Header: "octets",
+				Format: "%f",
+				Labels: []MonitorValueLabelConfig{{Header: "iface"}},
+				Rate:   true,
+			},
+		},
+		metric: tm,
+		now:    func() time.Time { return now },
+	}
+
+	for _, p := range []struct {
+		elapsed time.Duration
+		octets  string
+	}{
+		{0, "1000"},
+		{10 * time.Second, "6000"},
+		{15 * time.Second, "8500"},
+		{25 * time.Second, "100"}, // counter reset
+		{30 * time.Second, "600"},
+	} {
+		now = start.Add(p.elapsed)
+		m.push([]record{{"iface": "eth0", "octets": p.octets}})
+	}
+
+	assert.Equal(t, []metric{
+		{labels: []string{"eth0"}, value: 500},
+		{labels: []string{"eth0"}, value: 500},
+		{labels: []string{"eth0"}, value: 100},
+	}, tm.written)
+}
+
+func Test_Monitor_push_concurrent(t *testing.T) {
+	tests := []struct {
+		name string
+		c    MonitorConfig
+	}{
+		{"maxCardinality", MonitorConfig{}},
+		{"noDataPolicy delete", MonitorConfig{NoDataPolicy: "delete"}},
+		{"rate", MonitorConfig{Value: MonitorValueConfig{Rate: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.c.Value.Header = "power"
+			tt.c.Value.Format = "%f"
+			tt.c.Value.Labels = []MonitorValueLabelConfig{{Header: "name"}}
+			m := &Monitor{c: tt.c, metric: &testMetric{}, maxCardinality: 2}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					m.push([]record{{"name": fmt.Sprint("Downstream ", i%3), "power": "1"}})
+					m.seriesCount()
+				}(i)
+			}
+			wg.Wait()
+			assert.LessOrEqual(t, m.seriesCount(), 2)
+		})
+	}
+}
+
+func Test_Monitor_push_aggregate(t *testing.T) {
+	rr := []record{
+		{"name": "Downstream 1", "power": "2.5 dBmV"},
+		{"name": "Downstream 2", "power": "-1.5 dBmV"},
+		{"name": "Downstream 3", "power": "5 dBmV"},
+		{"name": "Downstream 4"},
+	}
+
+	tests := []struct {
+		aggregate   string
+		omitMissing bool
+		rr          []record
+		want        []metric
+	}{
+		{"sum", true, rr, []metric{{value: 6}}},
+		{"avg", true, rr, []metric{{value: 2}}},
+		{"min", true, rr, []metric{{value: -1.5}}},
+		{"max", true, rr, []metric{{value: 5}}},
+		{"count", true, rr, []metric{{value: 3}}},
+		{"count", false, rr, []metric{{value: 4}}},
+		{"avg", false, rr, []metric{{value: 1.5}}},
+		{"sum", true, nil, []metric{{value: 0}}},
+		{"count", true, nil, []metric{{value: 0}}},
+		{"max", true, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s omit=%v rows=%d", tt.aggregate, tt.omitMissing, len(tt.rr)), func(t *testing.T) {
+			tm := &testMetric{}
+			m := Monitor{
+				c: MonitorConfig{
+					Value: MonitorValueConfig{
+						Header:      "power",
+						Format:      "%f dBmV",
+						OmitMissing: tt.omitMissing,
+						Aggregate:   tt.aggregate,
+					},
+				},
+				metric: tm,
+			}
+
+			m.push(tt.rr)
+
+			assert.Equal(t, tt.want, tm.written)
+		})
+	}
+
+	config := testConfig
+	config.Monitors = append([]MonitorConfig(nil), testConfig.Monitors...)
+	config.Monitors[0].Value.Aggregate = "median"
+	assert.EqualError(t, config.Validate(), strings.Join([]string{
+		`monitors.0.value.aggregate: unknown aggregation "median"`,
+		`monitors.0.value.aggregate: requires no labels`,
+	}, "; "))
+}
+
+func Test_Monitor_push_maxSeries(t *testing.T) {
+	rr := []record{
+		{"name": "Downstream 3", "power": "3"},
+		{"name": "Downstream 1", "power": "1"},
+		{"name": "Downstream 4", "power": "4"},
+		{"name": "Downstream 2", "power": "2"},
+		{"name": "Downstream 1", "power": "1.5"},
+	}
+	m := Monitor{
+		c: MonitorConfig{
+			Value: MonitorValueConfig{
+				Header: "power",
+				Format: "%f",
+				Labels: []MonitorValueLabelConfig{{Header: "name"}},
+			},
+		},
+		maxSeries: 2,
+	}
+
+	// the kept series don't depend on the record order
+	for _, rr := range [][]record{rr, {rr[3], rr[2], rr[1], rr[0], rr[4]}} {
+		tm := &testMetric{}
+		m.metric = tm
+		m.push(rr)
+
+		assert.ElementsMatch(t, []metric{
+			{labels: []string{"Downstream 1"}, value: 1},
+			{labels: []string{"Downstream 2"}, value: 2},
+			{labels: []string{"Downstream 1"}, value: 1.5},
+		}, tm.written)
+		assert.ElementsMatch(t, [][]string{
+			{"Downstream 3"},
+			{"Downstream 4"},
+		}, tm.deleted)
+	}
+}
+
+func Test_record_value_valueMap(t *testing.T) {
+	c := MonitorValueConfig{
+		Header: "state",
+		Format: "%f",
+		ValueMap: map[string]float64{
+			"locked":   1,
+			"unlocked": 0,
+			"true":     1,
+			"false":    0,
+		},
+	}
+
+	tests := []struct {
+		state  string
+		want   float64
+		wantOk bool
+	}{
+		{"locked", 1, true},
+		{" unlocked ", 0, true},
+		{"true", 1, true},
+		{"false", 0, true},
+		{"42", 42, true},
+		{"partial", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.state, func(t *testing.T) {
+			got, ok := record{"state": tt.state}.value(c)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got.value)
+		})
+	}
+}
+
+func Test_record_value_valueType(t *testing.T) {
+	tests := []struct {
+		name   string
+		c      MonitorValueConfig
+		raw    string
+		want   float64
+		wantOk bool
+	}{
+		{"go duration", MonitorValueConfig{ValueType: "duration"}, "1h30m", 5400, true},
+		{"human duration", MonitorValueConfig{ValueType: "duration"}, "up 5 days", 432000, true},
+		{"human duration parts", MonitorValueConfig{ValueType: "duration"}, "2 hours, 3 mins 4 sec", 7384, true},
+		{"bad duration", MonitorValueConfig{ValueType: "duration"}, "forever", 0, false},
+		{"rfc3339", MonitorValueConfig{ValueType: "timestamp"}, "2024-01-02T03:04:05Z", 1704164645, true},
+		{"layout", MonitorValueConfig{ValueType: "timestamp", TimeLayout: "2006-01-02 15:04"}, "2024-01-02 03:04", 1704164640, true},
+		{"bad timestamp", MonitorValueConfig{ValueType: "timestamp"}, "yesterday", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.c.Header = "value"
+			got, ok := record{"value": tt.raw}.value(tt.c)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got.value)
+		})
+	}
+}
+
+func Test_record_value_decimalSeparator(t *testing.T) {
+	tests := []struct {
+		name      string
+		separator string
+		raw       string
+		want      float64
+	}{
+		{"comma decimal", ",", "2,33 dBmV", 2.33},
+		{"dot thousands", ",", "1.234,56", 1234.56},
+		{"comma negative", ",", "-0,5", -0.5},
+		{"comma thousands", ".", "1,234.56", 1234.56},
+		{"dot decimal", ".", "2.33 dBmV", 2.33},
+		{"none", "", "1,234.56", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MonitorValueConfig{Header: "value", Format: "%f", DecimalSeparator: tt.separator}
+			got, ok := record{"value": tt.raw}.value(c)
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, got.value)
+		})
+	}
+}
+
 func Test_Source_pull(t *testing.T) {
 	sample := `
 	0:s0
@@ -213,7 +624,7 @@ func Test_Source_pull(t *testing.T) {
 				parser:  tt.parser,
 			}
 
-			got, err := s.pull()
+			got, err := s.pull(context.Background(), nil)
 			if tt.wantErr != "" {
 				assert.EqualError(t, err, tt.wantErr)
 			} else {
@@ -225,52 +636,110 @@ func Test_Source_pull(t *testing.T) {
 	}
 }
 
-func Test_csvParser_Parse(t *testing.T) {
-	sample := `
-	0:s0
-	255:s1
-	127:s2`
+func Test_Source_pull_commands(t *testing.T) {
+	s := Source{
+		command: &shellCommand{},
+		parser:  &csvParser{},
+	}
+	s.c.Timeout = 1 * time.Second
+	s.c.Commands = []string{
+		`printf "1:eth0\n2:eth1\n"`,
+		`printf "3:wlan0\n"`,
+	}
+	s.c.Output.Records = []ParserRecordConfig{
+		{Id: "ports", Header: []string{"index", "name"}},
+	}
+
+	got, err := s.pull(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, records{
+		"ports": []record{
+			{"index": "1", "name": "eth0"},
+			{"index": "2", "name": "eth1"},
+			{"index": "3", "name": "wlan0"},
+		},
+	}, got)
+
+	s.c.Commands = append(s.c.Commands, "exit 1")
+	_, err = s.pull(context.Background(), nil)
+	assert.EqualError(t, err, "exit status 1")
+}
+
+func Test_Source_pull_decompress(t *testing.T) {
+	sample := "0:s0\n255:s1\n"
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte(sample))
+	gw.Close()
+
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write([]byte(sample))
+	zw.Close()
+
+	want := records{
+		"wifi": []record{
+			{"signal": "0", "ssid": "s0"},
+			{"signal": "255", "ssid": "s1"},
+		},
+	}
 
 	tests := []struct {
-		name    string
-		records []ParserRecordConfig
-		want    records
-		wantErr string
+		name       string
+		decompress string
+		output     string
+		want       records
+		wantErr    string
 	}{
 		{
-			"test #1 (empty)",
-			[]ParserRecordConfig{},
-			records{},
-			"",
+			name:   "none",
+			output: sample,
+			want:   want,
 		},
 		{
-			"test #2 (correct)",
-			[]ParserRecordConfig{
-				{
-					Id:     "wifi",
-					Header: []string{"signal", "ssid"},
-					ParserOptions: map[string]string{
-						"separator": ":",
-					},
-				},
-			},
-			records{
-				"wifi": []record{
-					{"signal": "0", "ssid": "s0"},
-					{"signal": "255", "ssid": "s1"},
-					{"signal": "127", "ssid": "s2"},
-				},
-			},
-			"",
+			name:       "gzip",
+			decompress: "gzip",
+			output:     gzipped.String(),
+			want:       want,
+		},
+		{
+			name:       "deflate",
+			decompress: "deflate",
+			output:     deflated.String(),
+			want:       want,
+		},
+		{
+			name:       "error: malformed gzip",
+			decompress: "gzip",
+			output:     sample,
+			wantErr:    "source: malformed gzip data: gzip: invalid header",
+		},
+		{
+			name:       "error: truncated gzip",
+			decompress: "gzip",
+			output:     gzipped.String()[:gzipped.Len()-4],
+			wantErr:    "source: malformed gzip data: unexpected EOF",
+		},
+		{
+			name:       "error: invalid method",
+			decompress: "brotli",
+			output:     sample,
+			wantErr:    "source: invalid decompress method: brotli",
 		},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := &Source{}
-			s.c.Output.Records = tt.records
-			p := csvParser{}
-			got, err := p.Parse(s, strings.NewReader(sample))
+			s := Source{
+				command: &testCommand{res: tt.output},
+				parser:  &csvParser{},
+			}
+			s.c.Decompress = tt.decompress
+			s.c.Output.Records = []ParserRecordConfig{
+				{Id: "wifi", Header: []string{"signal", "ssid"}},
+			}
+
+			got, err := s.pull(context.Background(), nil)
 			if tt.wantErr != "" {
 				assert.EqualError(t, err, tt.wantErr)
 			} else {
@@ -281,45 +750,159 @@ func Test_csvParser_Parse(t *testing.T) {
 	}
 }
 
-func Test_htmlqueryParser_Parse(t *testing.T) {
-	sample := `
-	<table>
-		<tbody>
-			<tr>
-				<td></td>
-				<td>DCID</td>
-				<td>Freq</td>
-				<td>Power</td>
-			</tr>
-			<tr>
-				<td>Downstream 1</td>
-				<td>73</td>
-				<td>114.00 MHz</td>
-				<td>0.82 dBmV</td>
-			</tr>
-			<tr>
-				<td>Downstream 2</td>
-				<td>74</td>
-				<td>122.00 MHz</td>
-				<td>2.70 dBmV</td>
-			</tr>
-		</tbody>
-	</table>
-	<table>
-		<tbody>
-			<tr>
-				<td></td>
-				<td>UCID</td>
-				<td>Freq</td>
-			</tr>
-			<tr></tr>
-			<tr>
-				<td>Upstream 1</td>
-				<td>5</td>
-				<td>36.00 MHz</td>
-			</tr>
-		<tbody>
-	</table>`
+func Test_Source_pull_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  *Source
+		wantErr error
+	}{
+		{
+			"command failed",
+			&Source{command: &testCommand{err: fmt.Errorf("exit status 1")}, parser: &testParser{}},
+			ErrCommandFailed,
+		},
+		{
+			"timeout",
+			&Source{
+				c:       SourceConfig{Command: "sleep 1", Timeout: 50 * time.Millisecond},
+				command: &shellCommand{},
+				parser:  &testParser{},
+			},
+			ErrTimeout,
+		},
+		{
+			"parse failed",
+			&Source{command: &testCommand{}, parser: &testParser{err: fmt.Errorf("bad input")}},
+			ErrParseFailed,
+		},
+		{
+			"unknown parser",
+			&Source{c: SourceConfig{Output: SourceOutputConfig{Parser: "xml"}}, command: &testCommand{}},
+			ErrParseFailed,
+		},
+		{
+			"decompress failed",
+			&Source{
+				c:       SourceConfig{Decompress: "gzip"},
+				command: &testCommand{res: "plain"},
+				parser:  &testParser{},
+			},
+			ErrParseFailed,
+		},
+	}
+	kinds := []error{ErrCommandFailed, ErrTimeout, ErrParseFailed}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.source.pull(context.Background(), nil)
+			assert.Error(t, err)
+			for _, kind := range kinds {
+				assert.Equal(t, kind == tt.wantErr, errors.Is(err, kind), "%v is %v", err, kind)
+			}
+		})
+	}
+
+	s := &Source{
+		c:       SourceConfig{Command: "sleep 1", Timeout: 50 * time.Millisecond},
+		command: &shellCommand{},
+		parser:  &testParser{},
+	}
+	_, err := s.pull(context.Background(), nil)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.EqualError(t, err, context.DeadlineExceeded.Error())
+}
+
+func Test_Source_pull_transform(t *testing.T) {
+	s := &Source{
+		c: SourceConfig{
+			Timeout:   time.Second,
+			Transform: `sed -E 's/.*"signal": *([0-9]+).*"ssid": *"([^"]*)".*/\1:\2/'`,
+		},
+		command: &testCommand{res: "{\"signal\": 42, \"ssid\": \"home\"}\n{\"signal\": 7, \"ssid\": \"guest\"}\n"},
+		parser:  &csvParser{},
+	}
+	s.c.Output.Records = []ParserRecordConfig{
+		{Id: "wifi", Header: []string{"signal", "ssid"}},
+	}
+	got, err := s.pull(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, records{"wifi": []record{
+		{"signal": "42", "ssid": "home"},
+		{"signal": "7", "ssid": "guest"},
+	}}, got)
+
+	s.c.Transform = "echo bad json >&2; exit 3"
+	_, err = s.pull(context.Background(), nil)
+	assert.EqualError(t, err, "source: transform: exit status 3: bad json")
+	assert.True(t, errors.Is(err, ErrCommandFailed))
+
+	s.c.Transform = "sleep 1"
+	s.c.Timeout = 50 * time.Millisecond
+	_, err = s.pull(context.Background(), nil)
+	assert.True(t, errors.Is(err, ErrTimeout), err)
+}
+
+func Test_Source_pull_encoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		output   string
+		want     records
+		wantErr  string
+	}{
+		{
+			name:   "passthrough",
+			output: "0:Caf\xc3\xa9\n",
+			want:   records{"wifi": []record{{"signal": "0", "ssid": "Café"}}},
+		},
+		{
+			name:     "iso-8859-1",
+			encoding: "iso-8859-1",
+			output:   "0:Caf\xe9\n255:Stra\xdfe\n",
+			want: records{"wifi": []record{
+				{"signal": "0", "ssid": "Café"},
+				{"signal": "255", "ssid": "Straße"},
+			}},
+		},
+		{
+			name:     "windows-1252",
+			encoding: "windows-1252",
+			output:   "0:\x80uro\n",
+			want:     records{"wifi": []record{{"signal": "0", "ssid": "€uro"}}},
+		},
+		{
+			name:     "error: invalid encoding",
+			encoding: "latin-42",
+			output:   "0:s0\n",
+			wantErr:  "source: invalid encoding: latin-42",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Source{
+				command: &testCommand{res: tt.output},
+				parser:  &csvParser{},
+			}
+			s.c.Encoding = tt.encoding
+			s.c.Output.Records = []ParserRecordConfig{
+				{Id: "wifi", Header: []string{"signal", "ssid"}},
+			}
+
+			got, err := s.pull(context.Background(), nil)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_csvParser_Parse(t *testing.T) {
+	sample := `
+	0:s0
+	255:s1
+	127:s2`
 
 	tests := []struct {
 		name    string
@@ -332,64 +915,1436 @@ func Test_htmlqueryParser_Parse(t *testing.T) {
 			[]ParserRecordConfig{},
 			records{},
 			"",
-		}, {
-			"test #2 (bad parser format)",
+		},
+		{
+			"test #2 (correct)",
 			[]ParserRecordConfig{
 				{
-					ParserOptions: map[string]string{},
+					Id:     "wifi",
+					Header: []string{"signal", "ssid"},
+					ParserOptions: map[string]string{
+						"separator": ":",
+					},
+				},
+			},
+			records{
+				"wifi": []record{
+					{"signal": "0", "ssid": "s0"},
+					{"signal": "255", "ssid": "s1"},
+					{"signal": "127", "ssid": "s2"},
+				},
+			},
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Source{}
+			s.c.Output.Records = tt.records
+			p := csvParser{}
+			got, err := p.Parse(s, strings.NewReader(sample))
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_csvParser_Parse_options(t *testing.T) {
+	tests := []struct {
+		name    string
+		sample  string
+		options map[string]string
+		want    records
+		wantErr string
+	}{
+		{
+			"comment: not set",
+			"# signal:ssid\n0:s0",
+			map[string]string{},
+			records{
+				"wifi": []record{
+					{"signal": "# signal", "ssid": "ssid"},
+					{"signal": "0", "ssid": "s0"},
+				},
+			},
+			"",
+		},
+		{
+			"comment: set",
+			"# signal:ssid\n0:s0\n#255:s1",
+			map[string]string{"comment": "#"},
+			records{
+				"wifi": []record{
+					{"signal": "0", "ssid": "s0"},
+				},
+			},
+			"",
+		},
+		{
+			"comment: indented",
+			"\t# signal:ssid\n0:s0\n  #255:s1",
+			map[string]string{"comment": "#"},
+			records{
+				"wifi": []record{
+					{"signal": "0", "ssid": "s0"},
+				},
+			},
+			"",
+		},
+		{
+			"skipBlank: not set",
+			"0:s0\n  \n\n255:s1\n",
+			map[string]string{"fieldsPerRecord": "-1"},
+			records{
+				"wifi": []record{
+					{"signal": "0", "ssid": "s0"},
+					{"signal": "", "ssid": ""},
+					{"signal": "255", "ssid": "s1"},
+				},
+			},
+			"",
+		},
+		{
+			"skipBlank: set",
+			"# interfaces\n\n0:s0\n  \n\t\n# end\n255:s1\n\n",
+			map[string]string{"skipBlank": "true", "comment": "#"},
+			records{
+				"wifi": []record{
+					{"signal": "0", "ssid": "s0"},
+					{"signal": "255", "ssid": "s1"},
 				},
 			},
+			"",
+		},
+		{
+			"skipBlank: invalid",
+			"0:s0",
+			map[string]string{"skipBlank": "sometimes"},
 			nil,
-			"htmlqueryParser: invalid parser option 'format': map[]",
-		}, {
-			"test #3 (bad parser path)",
-			[]ParserRecordConfig{
-				{
-					ParserOptions: map[string]string{
-						"format": "table",
-					},
+			"csvParser: invalid parser option 'skipBlank': map[skipBlank:sometimes]",
+		},
+		{
+			"comment: invalid",
+			"0:s0",
+			map[string]string{"comment": "##"},
+			nil,
+			"csvParser: invalid parser option 'comment': map[comment:##]",
+		},
+		{
+			"fieldsPerRecord: strict",
+			"0:s0\n255:s1:extra",
+			map[string]string{},
+			nil,
+			"record on line 2: wrong number of fields",
+		},
+		{
+			"fieldsPerRecord: lenient",
+			"0:s0\n255:s1:extra",
+			map[string]string{"fieldsPerRecord": "-1"},
+			records{
+				"wifi": []record{
+					{"signal": "0", "ssid": "s0"},
+					{"signal": "255", "ssid": "s1"},
 				},
 			},
+			"",
+		},
+		{
+			"fieldsPerRecord: strict short row",
+			"0:s0\n255",
+			map[string]string{},
 			nil,
-			"htmlqueryParser: invalid parser option 'path': map[format:table]",
-		}, {
-			"test #4 (correct record)",
-			[]ParserRecordConfig{
-				{
-					Id:                "downstream",
-					FirstLineIsHeader: true,
-					ParserOptions: map[string]string{
-						"format": "table",
-						"path":   "//table[1]/tbody",
-					},
-					Header: []string{"name", "dcid", "freq", "power"},
+			"record on line 2: wrong number of fields",
+		},
+		{
+			"fieldsPerRecord: lenient short row",
+			"0:s0\n255\n# ssid lost\n128:s2",
+			map[string]string{"fieldsPerRecord": "-1", "comment": "#"},
+			records{
+				"wifi": []record{
+					{"signal": "0", "ssid": "s0"},
+					{"signal": "255", "ssid": ""},
+					{"signal": "128", "ssid": "s2"},
+				},
+			},
+			"",
+		},
+		{
+			"fieldsPerRecord: invalid",
+			"0:s0",
+			map[string]string{"fieldsPerRecord": "any"},
+			nil,
+			"csvParser: invalid parser option 'fieldsPerRecord': map[fieldsPerRecord:any]",
+		},
+		{
+			"lazyQuotes: set",
+			`0:s"0`,
+			map[string]string{"lazyQuotes": "true"},
+			records{
+				"wifi": []record{
+					{"signal": "0", "ssid": `s"0`},
 				},
 			},
+			"",
+		},
+		{
+			"columns: set",
+			":Downstream 1:73:114.00 MHz:0.82 dBmV\n:Downstream 2:74:122.00 MHz:2.70 dBmV",
+			map[string]string{"columns": "name=1, freq=3, power=4"},
 			records{
-				"downstream": []record{
-					{
-						"dcid":  "73",
-						"freq":  "114.00 MHz",
-						"name":  "Downstream 1",
-						"power": "0.82 dBmV",
-					}, {
-						"dcid":  "74",
-						"freq":  "122.00 MHz",
-						"name":  "Downstream 2",
-						"power": "2.70 dBmV",
-					},
+				"wifi": []record{
+					{"name": "Downstream 1", "freq": "114.00 MHz", "power": "0.82 dBmV"},
+					{"name": "Downstream 2", "freq": "122.00 MHz", "power": "2.70 dBmV"},
 				},
 			},
 			"",
 		},
+		{
+			"columns: invalid",
+			"0:s0",
+			map[string]string{"columns": "signal=0,ssid"},
+			nil,
+			"csvParser: invalid parser option 'columns': expected name=index, got \"ssid\"",
+		},
+		{
+			"columns: invalid index",
+			"0:s0",
+			map[string]string{"columns": "signal=-1"},
+			nil,
+			"csvParser: invalid parser option 'columns': invalid column index for \"signal\": \"-1\"",
+		},
+		{
+			"lazyQuotes: invalid",
+			"0:s0",
+			map[string]string{"lazyQuotes": "maybe"},
+			nil,
+			"csvParser: invalid parser option 'lazyQuotes': map[lazyQuotes:maybe]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Source{}
+			s.c.Output.Records = []ParserRecordConfig{
+				{
+					Id:            "wifi",
+					Header:        []string{"signal", "ssid"},
+					ParserOptions: tt.options,
+				},
+			}
+			p := csvParser{}
+			got, err := p.Parse(s, strings.NewReader(tt.sample))
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_csvParser_Parse_fixedWidths(t *testing.T) {
+	sample := `
+Iface     RX-OK     TX-OK  Flg
+eth0      1234567   89012  BMRU
+wlan0     42        7      BMRU
+lo        100
+`
+
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    records
+		wantErr string
+	}{
+		{
+			"widths",
+			map[string]string{"fixedWidths": "10,10,7,4"},
+			records{
+				"iface": []record{
+					{"iface": "eth0", "rx": "1234567", "tx": "89012", "flags": "BMRU"},
+					{"iface": "wlan0", "rx": "42", "tx": "7", "flags": "BMRU"},
+					{"iface": "lo", "rx": "100", "tx": "", "flags": ""},
+				},
+			},
+			"",
+		},
+		{
+			"invalid width",
+			map[string]string{"fixedWidths": "10,x"},
+			nil,
+			"csvParser: invalid parser option 'fixedWidths': invalid column width \"x\"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Source{}
+			s.c.Output.Records = []ParserRecordConfig{
+				{
+					Id:                "iface",
+					FirstLineIsHeader: true,
+					Header:            []string{"iface", "rx", "tx", "flags"},
+					ParserOptions:     tt.options,
+				},
+			}
+			got, err := (&csvParser{}).Parse(s, strings.NewReader(sample))
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_csvParser_Parse_split(t *testing.T) {
+	sample := `
+Filesystem      Size  Used Avail Use% Mounted on
+/dev/sda1        50G   21G   27G  44% /
+tmpfs           3.9G     0  3.9G   0% /dev/shm
+/dev/sdb1       916G  512G  358G  59% /media/My Disk
+`
+	header := []string{"filesystem", "size", "used", "avail", "use", "mount"}
+
+	tests := []struct {
+		name    string
+		header  []string
+		options map[string]string
+		want    records
+		wantErr string
+	}{
+		{
+			"default pattern",
+			header,
+			map[string]string{"format": "split"},
+			records{
+				"df": []record{
+					{"filesystem": "/dev/sda1", "size": "50G", "used": "21G", "avail": "27G", "use": "44%", "mount": "/"},
+					{"filesystem": "tmpfs", "size": "3.9G", "used": "0", "avail": "3.9G", "use": "0%", "mount": "/dev/shm"},
+					{"filesystem": "/dev/sdb1", "size": "916G", "used": "512G", "avail": "358G", "use": "59%", "mount": "/media/My Disk"},
+				},
+			},
+			"",
+		},
+		{
+			"pattern",
+			[]string{"filesystem", "size", "used", "avail", "usage"},
+			map[string]string{"format": "split", "splitPattern": `\s{2,}`},
+			records{
+				"df": []record{
+					{"filesystem": "/dev/sda1", "size": "50G", "used": "21G", "avail": "27G", "usage": "44% /"},
+					{"filesystem": "tmpfs", "size": "3.9G", "used": "0", "avail": "3.9G", "usage": "0% /dev/shm"},
+					{"filesystem": "/dev/sdb1", "size": "916G", "used": "512G", "avail": "358G", "usage": "59% /media/My Disk"},
+				},
+			},
+			"",
+		},
+		{
+			"invalid pattern",
+			header,
+			map[string]string{"format": "split", "splitPattern": "("},
+			nil,
+			"csvParser: invalid parser option 'splitPattern': error parsing regexp: missing closing ): `(`",
+		},
+		{
+			"invalid format",
+			header,
+			map[string]string{"format": "tsv"},
+			nil,
+			"csvParser: invalid parser option 'format': \"tsv\"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Source{}
+			s.c.Output.Records = []ParserRecordConfig{
+				{Id: "df", FirstLineIsHeader: true, Header: tt.header, ParserOptions: tt.options},
+			}
+			got, err := (&csvParser{}).Parse(s, strings.NewReader(sample))
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_splitReader_ReadAll(t *testing.T) {
+	got, err := (&splitReader{input: []byte("  a  b\tc \n\nd e\n"), re: regexp.MustCompile(DefaultSplitPattern)}).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"a", "b", "c"}, {"d", "e"}}, got)
+}
+
+func Test_csvParser_Parse_headerPattern(t *testing.T) {
+	sample := "host:queue_mail_depth:queue_mail_age:queue_sms_depth\n" +
+		"mx1:12:30:4\n" +
+		"mx2:0:0:7\n"
+
+	s := &Source{}
+	s.c.Output.Records = []ParserRecordConfig{
+		{
+			Id:                "queues",
+			FirstLineIsHeader: true,
+			HeaderPattern:     `^queue_\w+_depth$`,
+		},
+	}
+	got, err := (&csvParser{}).Parse(s, strings.NewReader(sample))
+	assert.NoError(t, err)
+	assert.Equal(t, records{
+		"queues": []record{
+			{"queue_mail_depth": "12", "queue_sms_depth": "4"},
+			{"queue_mail_depth": "0", "queue_sms_depth": "7"},
+		},
+	}, got)
+}
+
+func Test_csvParser_Parse_strictHeader(t *testing.T) {
+	s := &Source{}
+	s.c.Output.Records = []ParserRecordConfig{
+		{
+			Id:                "wifi",
+			FirstLineIsHeader: true,
+			Header:            []string{"ssid", "signal"},
+			StrictHeader:      true,
+		},
+	}
+
+	got, err := (&csvParser{}).Parse(s, strings.NewReader("ssid: signal\nhome:42\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, records{"wifi": []record{{"ssid": "home", "signal": "42"}}}, got)
+
+	_, err = (&csvParser{}).Parse(s, strings.NewReader("signal:ssid\n42:home\n"))
+	assert.EqualError(t, err, `csvParser: record "wifi": header mismatch: expected ["ssid" "signal"], got ["signal" "ssid"]`)
+
+	// not strict, the reordered columns are read by position
+	s.c.Output.Records[0].StrictHeader = false
+	got, err = (&csvParser{}).Parse(s, strings.NewReader("signal:ssid\n42:home\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, records{"wifi": []record{{"ssid": "42", "signal": "home"}}}, got)
+}
+
+func Test_table_zip(t *testing.T) {
+	data := table{
+		{"", "UCID", "Freq"},
+		{"Upstream 1", "5", "36.00 MHz"},
+		{"Upstream 2"},
+	}
+	header := []string{"name", "ucid", "freq"}
+
+	tests := []struct {
+		name          string
+		skipFirstLine bool
+		skipShortRows bool
+		want          []record
+	}{
+		{
+			"fill short rows",
+			true,
+			false,
+			[]record{
+				{"name": "Upstream 1", "ucid": "5", "freq": "36.00 MHz"},
+				{"name": "Upstream 2", "ucid": "", "freq": ""},
+			},
+		}, {
+			"skip short rows",
+			true,
+			true,
+			[]record{
+				{"name": "Upstream 1", "ucid": "5", "freq": "36.00 MHz"},
+			},
+		}, {
+			"keep first line",
+			false,
+			true,
+			[]record{
+				{"name": "", "ucid": "UCID", "freq": "Freq"},
+				{"name": "Upstream 1", "ucid": "5", "freq": "36.00 MHz"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := data.zip(header, tt.skipFirstLine, tt.skipShortRows)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_table_zip_widthMismatch(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	defer log.SetLevel(level)
+
+	data := table{
+		{},
+		{"Channel", "Power"},
+		{"1", "-2.5 dBmV", "38.9 dB", "Locked"},
+		{"2"},
+	}
+	header := []string{"channel", "power", "snr"}
+
+	got := data.zip(header, false, false)
+	assert.Equal(t, []record{
+		{"channel": "", "power": "", "snr": ""},
+		{"channel": "Channel", "power": "Power", "snr": ""},
+		{"channel": "1", "power": "-2.5 dBmV", "snr": "38.9 dB"},
+		{"channel": "2", "power": "", "snr": ""},
+	}, got)
+	if assert.NotNil(t, hook.LastEntry()) {
+		assert.Equal(t, log.DebugLevel, hook.LastEntry().Level)
+		assert.Equal(t, "4 row(s) not matching the header width 3", hook.LastEntry().Message)
+	}
+
+	// a short header line taken as header names
+	got = table{{"channel", "power"}, {"1", "-2.5 dBmV", "38.9 dB"}}.zip(nil, true, false)
+	assert.Equal(t, []record{{"channel": "1", "power": "-2.5 dBmV"}}, got)
+
+	hook.Reset()
+	table{{"1", "-2.5 dBmV", "38.9 dB"}}.zip(header, false, false)
+	assert.Nil(t, hook.LastEntry())
+}
+
+func Test_csvParser_Parse_filter(t *testing.T) {
+	sample := `type:channel:power
+	down:1:-2.5
+	up:1:41.0
+	down:2:-3.1
+	up:2:42.5`
+
+	s := &Source{}
+	s.c.Output.Records = []ParserRecordConfig{
+		{Id: "downstream", FirstLineIsHeader: true, ParserOptions: map[string]string{"filter": "type=down"}},
+		{Id: "upstream", FirstLineIsHeader: true, ParserOptions: map[string]string{"filter": "type=up"}},
+		{Id: "first", FirstLineIsHeader: true, ParserOptions: map[string]string{"filter": "channel=1"}},
+	}
+	got, err := (&csvParser{}).Parse(s, strings.NewReader(sample))
+	assert.NoError(t, err)
+	assert.Equal(t, records{
+		"downstream": []record{
+			{"type": "down", "channel": "1", "power": "-2.5"},
+			{"type": "down", "channel": "2", "power": "-3.1"},
+		},
+		"upstream": []record{
+			{"type": "up", "channel": "1", "power": "41.0"},
+			{"type": "up", "channel": "2", "power": "42.5"},
+		},
+		"first": []record{
+			{"type": "down", "channel": "1", "power": "-2.5"},
+			{"type": "up", "channel": "1", "power": "41.0"},
+		},
+	}, got)
+
+	s.c.Output.Records = []ParserRecordConfig{
+		{Id: "downstream", ParserOptions: map[string]string{"filter": "down"}},
+	}
+	_, err = (&csvParser{}).Parse(s, strings.NewReader(sample))
+	assert.EqualError(t, err, `csvParser: invalid parser option 'filter': expected column=value, got "down"`)
+}
+
+func Test_csvParser_Parse_firstLineHeader(t *testing.T) {
+	sample := `signal:ssid
+	0:s0
+	255:s1`
+
+	s := &Source{}
+	s.c.Output.Records = []ParserRecordConfig{
+		{Id: "wifi", FirstLineIsHeader: true},
+		{Id: "ssid", FirstLineIsHeader: true, Header: []string{"", "name"}},
+	}
+	got, err := (&csvParser{}).Parse(s, strings.NewReader(sample))
+	assert.NoError(t, err)
+	assert.Equal(t, records{
+		"wifi": []record{
+			{"signal": "0", "ssid": "s0"},
+			{"signal": "255", "ssid": "s1"},
+		},
+		"ssid": []record{
+			{"": "0", "name": "s0"},
+			{"": "255", "name": "s1"},
+		},
+	}, got)
+}
+
+func Test_table_zip_empty(t *testing.T) {
+	header := []string{"name", "freq"}
+
+	assert.Equal(t, []record{}, table{}.zip(header, true, false))
+	assert.Equal(t, []record{}, table{}.zipMapped(map[string]int{"name": 0}, true))
+
+	s := &Source{}
+	s.c.Output.Records = []ParserRecordConfig{
+		{Id: "downstream", FirstLineIsHeader: true, Header: header},
+	}
+	got, err := (&csvParser{}).Parse(s, strings.NewReader(""))
+	assert.NoError(t, err)
+	assert.Equal(t, records{"downstream": []record{}}, got)
+}
+
+func Test_table_zipMapped(t *testing.T) {
+	data := table{
+		{"Downstream 1", "", "114.00 MHz", "0.82 dBmV"},
+		{"Downstream 2", "", "122.00 MHz", "2.70 dBmV"},
+		{"Downstream 3"},
+	}
+	columns := map[string]int{"name": 0, "freq": 2, "power": 3}
+
+	got := data.zipMapped(columns, false)
+	assert.Equal(t, []record{
+		{"name": "Downstream 1", "freq": "114.00 MHz", "power": "0.82 dBmV"},
+		{"name": "Downstream 2", "freq": "122.00 MHz", "power": "2.70 dBmV"},
+		{"name": "Downstream 3", "freq": "", "power": ""},
+	}, got)
+}
+
+func Test_htmlqueryParser_Parse(t *testing.T) {
+	sample := `
+	<table>
+		<tbody>
+			<tr>
+				<td></td>
+				<td>DCID</td>
+				<td>Freq</td>
+				<td>Power</td>
+			</tr>
+			<tr>
+				<td>Downstream 1</td>
+				<td>73</td>
+				<td>114.00 MHz</td>
+				<td>0.82 dBmV</td>
+			</tr>
+			<tr>
+				<td>Downstream 2</td>
+				<td>74</td>
+				<td>122.00 MHz</td>
+				<td>2.70 dBmV</td>
+			</tr>
+		</tbody>
+	</table>
+	<table>
+		<tbody>
+			<tr>
+				<td></td>
+				<td>UCID</td>
+				<td>Freq</td>
+			</tr>
+			<tr></tr>
+			<tr>
+				<td>Upstream 1</td>
+				<td>5</td>
+				<td>36.00 MHz</td>
+			</tr>
+		<tbody>
+	</table>`
+
+	tests := []struct {
+		name    string
+		records []ParserRecordConfig
+		want    records
+		wantErr string
+	}{
+		{
+			"test #1 (empty)",
+			[]ParserRecordConfig{},
+			records{},
+			"",
+		}, {
+			"test #2 (bad parser format)",
+			[]ParserRecordConfig{
+				{
+					ParserOptions: map[string]string{},
+				},
+			},
+			nil,
+			"htmlqueryParser: invalid parser option 'format': map[]",
+		}, {
+			"test #3 (bad parser path)",
+			[]ParserRecordConfig{
+				{
+					ParserOptions: map[string]string{
+						"format": "table",
+					},
+				},
+			},
+			nil,
+			"htmlqueryParser: invalid parser option 'path': map[format:table]",
+		}, {
+			"test #4 (path matching nothing)",
+			[]ParserRecordConfig{
+				{
+					ParserOptions: map[string]string{
+						"format": "table",
+						"path":   "//table[3]/tbody",
+					},
+				},
+			},
+			nil,
+			"htmlqueryParser: path matched no nodes: //table[3]/tbody",
+		}, {
+			"test #5 (invalid path)",
+			[]ParserRecordConfig{
+				{
+					ParserOptions: map[string]string{
+						"format": "table",
+						"path":   "//table[3/tbody",
+					},
+				},
+			},
+			nil,
+			"htmlqueryParser: invalid parser option 'path': //table[3/tbody has an invalid token",
+		}, {
+			"test #6 (correct record)",
+			[]ParserRecordConfig{
+				{
+					Id:                "downstream",
+					FirstLineIsHeader: true,
+					ParserOptions: map[string]string{
+						"format": "table",
+						"path":   "//table[1]/tbody",
+					},
+					Header: []string{"name", "dcid", "freq", "power"},
+				},
+			},
+			records{
+				"downstream": []record{
+					{
+						"dcid":  "73",
+						"freq":  "114.00 MHz",
+						"name":  "Downstream 1",
+						"power": "0.82 dBmV",
+					}, {
+						"dcid":  "74",
+						"freq":  "122.00 MHz",
+						"name":  "Downstream 2",
+						"power": "2.70 dBmV",
+					},
+				},
+			},
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Source{}
+			s.c.Output.Records = tt.records
+			p := htmlqueryParser{}
+			got, err := p.Parse(s, strings.NewReader(sample))
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_htmlqueryParser_Parse_tables(t *testing.T) {
+	sample := `
+	<div class="group">
+		<table><tbody>
+			<tr><td>Channel</td><td>Power</td></tr>
+			<tr><td>1</td><td>0.82 dBmV</td></tr>
+			<tr><td>2</td><td>2.70 dBmV</td></tr>
+		</tbody></table>
+	</div>
+	<div class="group">
+		<table><tbody>
+			<tr><td>Channel</td><td>Power</td></tr>
+			<tr><td>3</td><td>1.10 dBmV</td></tr>
+		</tbody></table>
+	</div>
+	<div class="group">
+		<table><tbody>
+			<tr><td>Channel</td><td>Power</td></tr>
+			<tr><td>4</td><td>-0.50 dBmV</td></tr>
+		</tbody></table>
+	</div>`
+
+	s := &Source{}
+	s.c.Output.Records = []ParserRecordConfig{
+		{
+			Id:                "downstream",
+			FirstLineIsHeader: true,
+			ParserOptions: map[string]string{
+				"format": "table",
+				"path":   "//div[@class='group']/table/tbody",
+			},
+			Header: []string{"channel", "power"},
+		},
+	}
+	got, err := (&htmlqueryParser{}).Parse(s, strings.NewReader(sample))
+	assert.NoError(t, err)
+	assert.Equal(t, records{
+		"downstream": []record{
+			{"channel": "1", "power": "0.82 dBmV"},
+			{"channel": "2", "power": "2.70 dBmV"},
+			{"channel": "3", "power": "1.10 dBmV"},
+			{"channel": "4", "power": "-0.50 dBmV"},
+		},
+	}, got)
+}
+
+func Test_htmlqueryParser_Parse_list(t *testing.T) {
+	sample := `
+	<div class="chan" data-freq="114.00" data-power="0.82"><b>Downstream 1</b></div>
+	<div class="chan" data-freq="122.00"><b>Downstream 2</b></div>
+	<div class="other" data-freq="36.00"><b>Upstream 1</b></div>`
+
+	tests := []struct {
+		name    string
+		options map[string]string
+		header  []string
+		want    []record
+		wantErr bool
+	}{
+		{
+			"attributes",
+			map[string]string{
+				"format": "list",
+				"path":   "//div[@class='chan']",
+				"fields": "b, @data-freq, @data-power",
+			},
+			[]string{"name", "freq", "power"},
+			[]record{
+				{"name": "Downstream 1", "freq": "114.00", "power": "0.82"},
+				{"name": "Downstream 2", "freq": "122.00", "power": ""},
+			},
+			false,
+		}, {
+			"inner text",
+			map[string]string{
+				"format": "list",
+				"path":   "//div/b",
+			},
+			[]string{"name"},
+			[]record{
+				{"name": "Downstream 1"},
+				{"name": "Downstream 2"},
+				{"name": "Upstream 1"},
+			},
+			false,
+		}, {
+			"sub-path attribute",
+			map[string]string{
+				"format": "list",
+				"path":   "//body",
+				"fields": "div[@class='other']/@data-freq, i/@data-freq",
+			},
+			[]string{"freq", "missing"},
+			[]record{
+				{"freq": "36.00", "missing": ""},
+			},
+			false,
+		}, {
+			"bad path",
+			map[string]string{
+				"format": "list",
+				"path":   "//div[",
+			},
+			[]string{"name"},
+			nil,
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Source{}
+			s.c.Output.Records = []ParserRecordConfig{
+				{Id: "chan", ParserOptions: tt.options, Header: tt.header},
+			}
+			p := htmlqueryParser{}
+			got, err := p.Parse(s, strings.NewReader(sample))
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), "htmlqueryParser: ")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, records{"chan": tt.want}, got)
+		})
+	}
+}
+
+func Test_htmlqueryParser_Parse_css(t *testing.T) {
+	sample := `
+	<table class="status">
+		<tr><th>Channel</th><th>Freq</th><th>Power</th></tr>
+		<tr><td>Downstream 1</td><td>114.00 MHz</td><td>0.82 dBmV</td></tr>
+		<tr><td>Downstream 2</td><td>122.00 MHz</td><td>2.70 dBmV</td></tr>
+	</table>
+	<table class="other">
+		<tr><td>Upstream 1</td><td>36.00 MHz</td><td>40.0 dBmV</td></tr>
+	</table>
+	<ul>
+		<li class="chan" data-freq="114.00"><b>Downstream 1</b></li>
+		<li class="chan" data-freq="122.00"><b>Downstream 2</b></li>
+	</ul>`
+
+	tests := []struct {
+		name    string
+		options map[string]string
+		header  []string
+		want    []record
+		wantErr string
+	}{
+		{
+			"table cells",
+			map[string]string{
+				"format": "css",
+				"path":   "table.status tr",
+			},
+			[]string{"name", "freq", "power"},
+			[]record{
+				{"name": "Downstream 1", "freq": "114.00 MHz", "power": "0.82 dBmV"},
+				{"name": "Downstream 2", "freq": "122.00 MHz", "power": "2.70 dBmV"},
+			},
+			"",
+		}, {
+			"fields",
+			map[string]string{
+				"format": "css",
+				"path":   "li.chan",
+				"fields": "b, @data-freq, i",
+			},
+			[]string{"name", "freq", "missing"},
+			[]record{
+				{"name": "Downstream 1", "freq": "114.00", "missing": ""},
+				{"name": "Downstream 2", "freq": "122.00", "missing": ""},
+			},
+			"",
+		}, {
+			"bad path",
+			map[string]string{
+				"format": "css",
+				"path":   "table[",
+			},
+			nil,
+			nil,
+			"htmlqueryParser: invalid parser option 'path'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Source{}
+			s.c.Output.Records = []ParserRecordConfig{
+				{Id: "chan", ParserOptions: tt.options, Header: tt.header},
+			}
+			got, err := (&htmlqueryParser{}).Parse(s, strings.NewReader(sample))
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, records{"chan": tt.want}, got)
+		})
+	}
+}
+
+func Test_promParser_Parse(t *testing.T) {
+	sample := `
+# HELP node_network_receive_bytes_total Network device statistic receive_bytes.
+# TYPE node_network_receive_bytes_total counter
+node_network_receive_bytes_total{device="eth0"} 1.5e+06
+node_network_receive_bytes_total{device="lo"} 2048
+# TYPE ups_load gauge
+ups_load 37.5
+# TYPE sensor_reading gauge
+sensor_reading{sensor="door",value="open"} 1
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 4773
+rpc_duration_seconds_sum 1.7560473e+07
+rpc_duration_seconds_count 2693
+`
+
+	tests := []struct {
+		name    string
+		records []ParserRecordConfig
+		want    records
+		wantErr string
+	}{
+		{
+			"labels",
+			[]ParserRecordConfig{
+				{
+					Id: "rx",
+					ParserOptions: map[string]string{
+						"metric": "node_network_receive_bytes_total",
+					},
+				},
+			},
+			records{
+				"rx": []record{
+					{"device": "eth0", "value": "1500000"},
+					{"device": "lo", "value": "2048"},
+				},
+			},
+			"",
+		}, {
+			"record id as metric name",
+			[]ParserRecordConfig{
+				{Id: "ups_load"},
+				{Id: "missing"},
+			},
+			records{
+				"ups_load": []record{
+					{"value": "37.5"},
+				},
+				"missing": []record{},
+			},
+			"",
+		}, {
+			"value label renamed",
+			[]ParserRecordConfig{
+				{Id: "sensor_reading"},
+			},
+			records{
+				"sensor_reading": []record{
+					{"sensor": "door", "exported_value": "open", "value": "1"},
+				},
+			},
+			"",
+		}, {
+			"unsupported type",
+			[]ParserRecordConfig{
+				{Id: "rpc_duration_seconds"},
+			},
+			nil,
+			"promParser: unsupported metric type SUMMARY: rpc_duration_seconds",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Source{}
+			s.c.Output.Records = tt.records
+			p := promParser{}
+			got, err := p.Parse(s, strings.NewReader(sample))
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_shellCommand_Execute(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     string
+		timeout time.Duration
+		want    []byte
+		wantErr string
+	}{
+		{
+			name:    "empty",
+			wantErr: "context deadline exceeded",
+		},
+		{
+			name:    "echo",
+			cmd:     "echo test",
+			timeout: 1 * time.Second,
+			want:    []byte("test\n"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Source{}
+			s.c.Command = tt.cmd
+			s.c.Timeout = tt.timeout
+			c := shellCommand{}
+			got, err := c.Execute(context.Background(), s)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_shellCommand_Execute_cancel(t *testing.T) {
+	s := &Source{}
+	s.c.Command = "sleep 5"
+	s.c.Timeout = 10 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := (&shellCommand{}).Execute(ctx, s)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 1*time.Second, "command not killed on cancel")
+}
+
+func Test_WatchService_pullSources_cancel(t *testing.T) {
+	ws := newWatchService()
+	s := &Source{
+		command: &shellCommand{},
+		parser:  &testParser{res: records{}},
+	}
+	s.c.Id = "slow"
+	s.c.Command = "sleep 5"
+	s.c.Timeout = 10 * time.Second
+	ws.sources = []*Source{s}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	data := ws.pullSources(ctx, nil)
+	assert.True(t, time.Since(start) < 1*time.Second, "pull not stopped on cancel")
+	_, ok := data.Load("slow")
+	assert.False(t, ok)
+}
+
+func Test_fileCommand_Execute(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "output.csv")
+	err := os.WriteFile(filename, []byte("0:s0\n"), 0644)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		file    string
+		timeout time.Duration
+		want    []byte
+		wantErr string
+	}{
+		{
+			name:    "ok",
+			file:    filename,
+			timeout: 1 * time.Second,
+			want:    []byte("0:s0\n"),
+		},
+		{
+			name:    "missing",
+			file:    filepath.Join(dir, "missing.csv"),
+			timeout: 1 * time.Second,
+			wantErr: "fileCommand: open " + filepath.Join(dir, "missing.csv") + ": no such file or directory",
+		},
+		{
+			name:    "timeout",
+			file:    filename,
+			wantErr: "context deadline exceeded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Source{}
+			s.c.File = tt.file
+			s.c.Timeout = tt.timeout
+			c := fileCommand{}
+			got, err := c.Execute(context.Background(), s)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_tcpCommand_Execute(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				request, _ := bufio.NewReader(conn).ReadString('\n')
+				switch request {
+				case "STATUS\n":
+					io.WriteString(conn, "LOADPCT:37.0\nBCHARGE:100.0\nEND\n")
+				case "CLOSE\n":
+					io.WriteString(conn, "LOADPCT:37.0\n")
+				case "HANG\n":
+					time.Sleep(1 * time.Second)
+				}
+			}(conn)
+		}
+	}()
+
+	addr := "tcp://" + ln.Addr().String()
+	tests := []struct {
+		name      string
+		addr      string
+		request   string
+		delimiter string
+		want      []byte
+		wantErr   string
+	}{
+		{
+			name:      "delimiter",
+			addr:      addr,
+			request:   "STATUS\n",
+			delimiter: "END\n",
+			want:      []byte("LOADPCT:37.0\nBCHARGE:100.0\n"),
+		},
+		{
+			name:    "eof",
+			addr:    addr,
+			request: "CLOSE\n",
+			want:    []byte("LOADPCT:37.0\n"),
+		},
+		{
+			name:    "timeout",
+			addr:    addr,
+			request: "HANG\n",
+			wantErr: "tcpCommand: read tcp",
+		},
+		{
+			name:    "invalid address",
+			addr:    ln.Addr().String(),
+			wantErr: "tcpCommand: invalid address: " + ln.Addr().String(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Source{}
+			s.c.Addr = tt.addr
+			s.c.Request = tt.request
+			s.c.Delimiter = tt.delimiter
+			s.c.Timeout = 100 * time.Millisecond
+			c := tcpCommand{}
+			got, err := c.Execute(context.Background(), s)
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_unixCommand_Execute(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				request, _ := bufio.NewReader(conn).ReadString('\n')
+				if request == "stats\n" {
+					io.WriteString(conn, "queue:3\nworkers:8\n")
+				}
+			}(conn)
+		}
+	}()
+
+	tests := []struct {
+		name    string
+		addr    string
+		want    []byte
+		wantErr string
+	}{
+		{
+			name: "ok",
+			addr: "unix://" + path,
+			want: []byte("queue:3\nworkers:8\n"),
+		},
+		{
+			name:    "missing socket",
+			addr:    "unix://" + path + ".missing",
+			wantErr: "unixCommand: dial unix " + path + ".missing",
+		},
+		{
+			name:    "invalid address",
+			addr:    path,
+			wantErr: "unixCommand: invalid address: " + path,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Source{}
+			s.c.Addr = tt.addr
+			s.c.Request = "stats\n"
+			s.c.Timeout = 100 * time.Millisecond
+			c := unixCommand{}
+			got, err := c.Execute(context.Background(), s)
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_httpCommand_Execute(t *testing.T) {
+	type request struct {
+		method      string
+		contentType string
+		body        string
+	}
+	var got request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = request{r.Method, r.Header.Get("Content-Type"), string(body)}
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "queue:3\n")
+	}))
+	defer server.Close()
+	t.Setenv("WATCHMON_TEST_PASSWORD", "s3cret")
+
+	tests := []struct {
+		name        string
+		addr        string
+		method      string
+		body        string
+		contentType string
+		wantRequest request
+		want        []byte
+		wantErr     string
+	}{
+		{
+			name:        "get",
+			addr:        server.URL + "/stats",
+			wantRequest: request{"GET", "", ""},
+			want:        []byte("queue:3\n"),
+		},
+		{
+			name:        "post",
+			addr:        server.URL + "/stats",
+			method:      "POST",
+			body:        `{"user": "admin", "password": "${WATCHMON_TEST_PASSWORD}"}`,
+			contentType: "application/json",
+			wantRequest: request{"POST", "application/json", `{"user": "admin", "password": "s3cret"}`},
+			want:        []byte("queue:3\n"),
+		},
+		{
+			name:        "post literal dollar",
+			addr:        server.URL + "/stats",
+			method:      "POST",
+			body:        `{"$filter": "up", "password": "pa$$word$", "token": "$WATCHMON_TEST_PASSWORD"}`,
+			contentType: "application/json",
+			wantRequest: request{"POST", "application/json", `{"$filter": "up", "password": "pa$$word$", "token": "$WATCHMON_TEST_PASSWORD"}`},
+			want:        []byte("queue:3\n"),
+		},
+		{
+			name:        "not found",
+			addr:        server.URL + "/missing",
+			wantRequest: request{"GET", "", ""},
+			wantErr:     "httpCommand: unexpected status 404 Not Found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = request{}
+			s := &Source{}
+			s.c.Addr = tt.addr
+			s.c.Method = tt.method
+			s.c.Body = tt.body
+			s.c.ContentType = tt.contentType
+			s.c.Timeout = time.Second
+			res, err := (&httpCommand{}).Execute(context.Background(), s)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, res)
+			assert.Equal(t, tt.wantRequest, got)
+		})
 	}
+}
+
+func Test_httpCommand_Execute_steps(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Method != "POST" || r.PostForm.Get("password") != "s3cret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "42", Path: "/"})
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != "42" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, "queue:3\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
 
+	tests := []struct {
+		name     string
+		password string
+		steps    bool
+		want     []byte
+		wantErr  string
+	}{
+		{
+			name:     "logged in",
+			password: "s3cret",
+			steps:    true,
+			want:     []byte("queue:3\n"),
+		},
+		{
+			name:    "no login",
+			wantErr: "httpCommand: unexpected status 401 Unauthorized",
+		},
+		{
+			name:     "login failure",
+			password: "wrong",
+			steps:    true,
+			wantErr:  "httpCommand: step 0: unexpected status 403 Forbidden",
+		},
+	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Source{}
-			s.c.Output.Records = tt.records
-			p := htmlqueryParser{}
-			got, err := p.Parse(s, strings.NewReader(sample))
+			s.c.Addr = server.URL + "/stats"
+			s.c.Timeout = time.Second
+			if tt.steps {
+				s.c.Steps = []HTTPStepConfig{{
+					Addr:        server.URL + "/login",
+					Method:      "POST",
+					Body:        "user=admin&password=" + tt.password,
+					ContentType: "application/x-www-form-urlencoded",
+				}}
+			}
+			got, err := (&httpCommand{}).Execute(context.Background(), s)
 			if tt.wantErr != "" {
 				assert.EqualError(t, err, tt.wantErr)
 			} else {
@@ -400,34 +2355,62 @@ func Test_htmlqueryParser_Parse(t *testing.T) {
 	}
 }
 
-func Test_shellCommand_Execute(t *testing.T) {
+func Test_httpCommand_Execute_tls(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "queue:3\n")
+	}))
+	defer server.Close()
+
+	caCertFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(caCertFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}), 0644))
+	otherCertFile := filepath.Join(t.TempDir(), "other.pem")
+	assert.NoError(t, os.WriteFile(otherCertFile, []byte("not a certificate"), 0644))
+
 	tests := []struct {
-		name    string
-		cmd     string
-		timeout time.Duration
-		want    []byte
-		wantErr string
+		name               string
+		insecureSkipVerify bool
+		caCertFile         string
+		want               []byte
+		wantErr            string
+		wantUnverified     bool
 	}{
 		{
-			name:    "empty",
-			wantErr: "context deadline exceeded",
+			name:           "verified",
+			wantErr:        "certificate",
+			wantUnverified: true,
 		},
 		{
-			name:    "echo",
-			cmd:     "echo test",
-			timeout: 1 * time.Second,
-			want:    []byte("test\n"),
+			name:               "insecure",
+			insecureSkipVerify: true,
+			want:               []byte("queue:3\n"),
+		},
+		{
+			name:       "ca pinned",
+			caCertFile: caCertFile,
+			want:       []byte("queue:3\n"),
+		},
+		{
+			name:       "ca invalid",
+			caCertFile: otherCertFile,
+			wantErr:    "httpCommand: " + otherCertFile + ": no certificate found",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Source{}
-			s.c.Command = tt.cmd
-			s.c.Timeout = tt.timeout
-			c := shellCommand{}
-			got, err := c.Execute(s)
+			s.c.Addr = server.URL
+			s.c.Timeout = DefaultTimeout
+			s.c.InsecureSkipVerify = tt.insecureSkipVerify
+			s.c.CACertFile = tt.caCertFile
+			got, err := (&httpCommand{}).Execute(context.Background(), s)
 			if tt.wantErr != "" {
-				assert.EqualError(t, err, tt.wantErr)
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				var verifyErr *tls.CertificateVerificationError
+				assert.Equal(t, tt.wantUnverified, errors.As(err, &verifyErr), "%v", err)
 			} else {
 				assert.NoError(t, err)
 			}
@@ -436,6 +2419,33 @@ func Test_shellCommand_Execute(t *testing.T) {
 	}
 }
 
+func Test_streamCommand_Execute(t *testing.T) {
+	s := &Source{}
+	s.c.Command = "for i in 1 2 3 4 5; do echo $i; sleep 0.1; done"
+	c := streamCommand{}
+
+	var (
+		output    []byte
+		snapshots int
+		err       error
+	)
+	for i := 0; i < 20; i++ {
+		var got []byte
+		got, err = c.Execute(context.Background(), s)
+		if err != nil {
+			break
+		}
+		if len(got) > 0 {
+			snapshots++
+		}
+		output = append(output, got...)
+		time.Sleep(150 * time.Millisecond)
+	}
+	assert.EqualError(t, err, "streamCommand: process exited")
+	assert.Equal(t, "1\n2\n3\n4\n5\n", string(output))
+	assert.Greater(t, snapshots, 1)
+}
+
 func Test_gaugeMetric_Write(t *testing.T) {
 	m := &Monitor{
 		gauge: prom.NewGaugeVec(
@@ -443,7 +2453,7 @@ func Test_gaugeMetric_Write(t *testing.T) {
 		),
 	}
 	g := &gaugeMetric{}
-	v := metric{[]string{"A", "B"}, 123}
+	v := metric{labels: []string{"A", "B"}, value: 123}
 
 	err := g.Write(m, v)
 	assert.NoError(t, err)
@@ -456,6 +2466,42 @@ func Test_gaugeMetric_Write(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, v.value, *written.Gauge.Value)
 	assert.Equal(t, 2, len(written.Label))
+
+	assert.True(t, g.Delete(m, v.labels))
+	assert.False(t, g.Delete(m, v.labels))
+}
+
+func Test_timestampCollector(t *testing.T) {
+	ws := NewWatchService(AppConfig{
+		Monitors: []MonitorConfig{
+			{
+				Id: "ups_load",
+				Value: MonitorValueConfig{
+					Header:          "load",
+					TimestampHeader: "time",
+					Labels:          []MonitorValueLabelConfig{{Header: "name"}},
+				},
+			},
+		},
+	})
+	ws.monitors[0].push([]record{
+		{"name": "ups1", "load": "37", "time": "2024-01-02T03:04:05Z"},
+		{"name": "ups2", "load": "12", "time": "n/a"},
+	})
+
+	var buf bytes.Buffer
+	families, err := ws.Gatherer().Gather()
+	assert.NoError(t, err)
+	for _, mf := range families {
+		if mf.GetName() == "ups_load" {
+			expfmt.MetricFamilyToText(&buf, mf)
+		}
+	}
+	assert.Contains(t, buf.String(), `ups_load{name="ups1"} 37 1704164645000`+"\n")
+	assert.Contains(t, buf.String(), `ups_load{name="ups2"} 12`+"\n")
+
+	ws.monitors[0].metric.Delete(ws.monitors[0], []string{"ups1"})
+	assert.Empty(t, ws.monitors[0].timestamps.timestamps)
 }
 
 func Test_WatchService_Start(t *testing.T) {
@@ -469,7 +2515,9 @@ func Test_WatchService_Start(t *testing.T) {
 		{
 			name: "start and stop",
 			run: func(m *Monitor, s *Source) {
-				ws := WatchService{[]*Monitor{m}, []*Source{s}}
+				ws := newWatchService()
+				ws.monitors = []*Monitor{m}
+				ws.sources = []*Source{s}
 				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
 				defer cancel()
 
@@ -492,3 +2540,664 @@ func Test_WatchService_Start(t *testing.T) {
 		})
 	}
 }
+
+func Test_WatchService_RunOnce(t *testing.T) {
+	ws := NewWatchService(AppConfig{
+		Monitors: []MonitorConfig{
+			{
+				Id:    "signal",
+				Title: "Signal",
+				Value: MonitorValueConfig{
+					SourceId: "network",
+					RecordId: "wifi",
+					Header:   "signal",
+					Labels:   []MonitorValueLabelConfig{{Header: "ssid"}},
+				},
+			},
+		},
+		Sources: []SourceConfig{
+			{
+				Id:      "network",
+				Command: "echo 42:home",
+				Output: SourceOutputConfig{
+					Parser: "csv",
+					Records: []ParserRecordConfig{
+						{Id: "wifi", Header: []string{"signal", "ssid"}},
+					},
+				},
+			},
+		},
+	})
+
+	err := ws.RunOnce(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, testutil.GatherAndCompare(ws.Gatherer(), strings.NewReader(`
+# HELP signal Signal
+# TYPE signal gauge
+signal{ssid="home"} 42
+`), "signal"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, ws.RunOnce(ctx))
+}
+
+func Test_sanitizeName(t *testing.T) {
+	tests := []struct {
+		name   string
+		colons bool
+		want   string
+	}{
+		{"power", false, "power"},
+		{"Max Power", false, "Max_Power"},
+		{"rx-bytes", false, "rx_bytes"},
+		{"5ghz", false, "_5ghz"},
+		{"--flags", false, "_flags"},
+		{"node:rx-bytes", false, "node_rx_bytes"},
+		{"node:rx-bytes", true, "node:rx_bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, sanitizeName(tt.name, tt.colons))
+		})
+	}
+}
+
+func Test_WatchService_sanitizedNames(t *testing.T) {
+	ws := NewWatchService(AppConfig{
+		Monitors: []MonitorConfig{
+			{
+				Id:    "arris-power",
+				Title: "Power",
+				Value: MonitorValueConfig{
+					SourceId: "arris",
+					RecordId: "downstream",
+					Header:   "Max Power",
+					Labels:   []MonitorValueLabelConfig{{Header: "Channel Id"}, {Header: "rx-bytes"}},
+				},
+			},
+		},
+		Sources: []SourceConfig{
+			{
+				Id:      "arris",
+				Command: "echo 7:1:1024",
+				Output: SourceOutputConfig{
+					Parser: "csv",
+					Records: []ParserRecordConfig{
+						{Id: "downstream", Header: []string{"Max Power", "Channel Id", "rx-bytes"}},
+					},
+				},
+			},
+		},
+	})
+
+	assert.NoError(t, ws.RunOnce(context.Background()))
+	assert.NoError(t, testutil.GatherAndCompare(ws.Gatherer(), strings.NewReader(`
+# HELP arris_power Power
+# TYPE arris_power gauge
+arris_power{Channel_Id="1",rx_bytes="1024"} 7
+`), "arris_power"))
+}
+
+func Test_WatchService_unknownMonitorType(t *testing.T) {
+	ws := NewWatchService(AppConfig{
+		Monitors: []MonitorConfig{
+			{
+				Id:    "signal",
+				Type:  "guage",
+				Value: MonitorValueConfig{SourceId: "network", RecordId: "wifi", Header: "signal"},
+			},
+		},
+		Sources: []SourceConfig{
+			{
+				Id:      "network",
+				Command: "echo 42:home",
+				Output: SourceOutputConfig{
+					Parser:  "csv",
+					Records: []ParserRecordConfig{{Id: "wifi", Header: []string{"signal", "ssid"}}},
+				},
+			},
+		},
+	})
+	assert.NotPanics(t, func() {
+		assert.NoError(t, ws.RunOnce(context.Background()))
+	})
+}
+
+func Test_WatchService_monitorUp(t *testing.T) {
+	ws := NewWatchService(AppConfig{
+		Monitors: []MonitorConfig{
+			{
+				Id:    "signal",
+				Title: "Signal",
+				Value: MonitorValueConfig{SourceId: "network", RecordId: "wifi", Header: "signal"},
+			},
+		},
+		Sources: []SourceConfig{
+			{
+				Id: "network",
+				Output: SourceOutputConfig{
+					Parser: "csv",
+					Records: []ParserRecordConfig{
+						{Id: "wifi", Header: []string{"signal", "ssid"}},
+					},
+				},
+			},
+		},
+	})
+	command := &testCommand{res: "42:home"}
+	ws.sources[0].command = command
+
+	for _, tt := range []struct {
+		err    error
+		wantUp string
+	}{
+		{nil, "1"},
+		{fmt.Errorf("command failed"), "0"},
+		{nil, "1"},
+	} {
+		command.err = tt.err
+		assert.NoError(t, ws.RunOnce(context.Background()))
+		assert.NoError(t, testutil.GatherAndCompare(ws.Gatherer(), strings.NewReader(`
+# HELP watchmon_monitor_up Whether the monitor was updated by the last cycle.
+# TYPE watchmon_monitor_up gauge
+watchmon_monitor_up{id="signal"} `+tt.wantUp+"\n"), "watchmon_monitor_up"))
+	}
+}
+
+func Test_WatchService_addSourceLabel(t *testing.T) {
+	ws := NewWatchService(AppConfig{
+		Monitors: []MonitorConfig{
+			{
+				Id:             "signal",
+				Title:          "Signal",
+				AddSourceLabel: true,
+				Value: MonitorValueConfig{
+					SourceId: "network",
+					RecordId: "wifi",
+					Header:   "signal",
+					Labels:   []MonitorValueLabelConfig{{Header: "ssid"}},
+				},
+			},
+		},
+		Sources: []SourceConfig{
+			{
+				Id:      "network",
+				Command: "echo 42:home",
+				Output: SourceOutputConfig{
+					Parser: "csv",
+					Records: []ParserRecordConfig{
+						{Id: "wifi", Header: []string{"signal", "ssid"}},
+					},
+				},
+			},
+		},
+	})
+
+	assert.NoError(t, ws.RunOnce(context.Background()))
+	assert.NoError(t, testutil.GatherAndCompare(ws.Gatherer(), strings.NewReader(`
+# HELP signal Signal
+# TYPE signal gauge
+signal{source="network",ssid="home"} 42
+`), "signal"))
+}
+
+func Test_WatchService_maxCardinality(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	ws := NewWatchService(AppConfig{
+		MaxCardinality: 3,
+		Monitors: []MonitorConfig{
+			{
+				Id:    "conn",
+				Title: "Connections",
+				Value: MonitorValueConfig{
+					SourceId: "netstat",
+					RecordId: "conn",
+					Header:   "bytes",
+					Labels:   []MonitorValueLabelConfig{{Header: "port"}},
+				},
+			},
+		},
+		Sources: []SourceConfig{
+			{
+				Id:      "netstat",
+				Command: "printf '1:50001\\n2:50002\\n3:50003\\n4:50004\\n5:50005\\n'",
+				Output: SourceOutputConfig{
+					Parser: "csv",
+					Records: []ParserRecordConfig{
+						{Id: "conn", Header: []string{"bytes", "port"}},
+					},
+				},
+			},
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, ws.RunOnce(context.Background()))
+	}
+	assert.NoError(t, testutil.GatherAndCompare(ws.Gatherer(), strings.NewReader(`
+# HELP conn Connections
+# TYPE conn gauge
+conn{port="50001"} 1
+conn{port="50002"} 2
+conn{port="50003"} 3
+# HELP watchmon_monitor_series Number of series written by the monitor.
+# TYPE watchmon_monitor_series gauge
+watchmon_monitor_series{monitor="conn"} 3
+`), "conn", "watchmon_monitor_series"))
+
+	var warnings []string
+	for _, e := range hook.AllEntries() {
+		if e.Level == log.WarnLevel && e.Data["monitor"] == "conn" {
+			warnings = append(warnings, e.Message)
+		}
+	}
+	assert.Equal(t, []string{"Series over maxCardinality 3, 2 label sets not written"}, warnings)
+}
+
+func Test_WatchService_Start_sourceLastSuccess(t *testing.T) {
+	ws := newWatchService()
+	s := &Source{
+		command: &testCommand{},
+		parser:  &testParser{},
+	}
+	s.c.Id = "arris"
+	ws.sources = []*Source{s}
+
+	lastSuccess := func(refresh, timeout time.Duration) float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		ws.Start(ctx, refresh)
+		return testutil.ToFloat64(ws.sourceLastSuccess.WithLabelValues("arris"))
+	}
+
+	t1 := lastSuccess(1*time.Millisecond, 50*time.Millisecond)
+	assert.NotZero(t, t1)
+
+	t2 := lastSuccess(1*time.Millisecond, 50*time.Millisecond)
+	assert.Greater(t, t2, t1)
+}
+
+func Test_WatchService_pullSources_dependsOn(t *testing.T) {
+	lister := &Source{
+		command: &testCommand{res: "eth0\nwlan0\n"},
+		parser:  &csvParser{},
+	}
+	lister.c.Id = "interfaces"
+	lister.c.Output.Records = []ParserRecordConfig{
+		{Id: "list", Header: []string{"name"}},
+	}
+
+	stats := &Source{
+		command: &shellCommand{},
+		parser:  &csvParser{},
+	}
+	stats.c.Id = "stats"
+	stats.c.Command = "echo {{.name}}:1"
+	stats.c.Timeout = 1 * time.Second
+	stats.c.DependsOn = SourceDependency{SourceId: "interfaces", RecordId: "list"}
+	stats.c.Output.Records = []ParserRecordConfig{
+		{Id: "rx", Header: []string{"name", "bytes"}},
+	}
+
+	ws := newWatchService()
+	ws.sources = []*Source{stats, lister}
+
+	data := ws.pullSources(context.Background(), nil)
+
+	got, ok := data.Load("stats")
+	assert.True(t, ok)
+	assert.Equal(t, records{
+		"rx": []record{
+			{"name": "eth0", "bytes": "1"},
+			{"name": "wlan0", "bytes": "1"},
+		},
+	}, got)
+}
+
+func Test_Source_execute_dependsOnQuoted(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "pwned")
+	s := &Source{command: &shellCommand{}}
+	s.c.Id = "stats"
+	s.c.Command = "echo {{.name}}:1"
+	s.c.Timeout = 1 * time.Second
+	s.c.DependsOn = SourceDependency{SourceId: "interfaces", RecordId: "list"}
+
+	got, err := s.execute(context.Background(), []record{
+		{"name": "eth0; touch " + marker},
+		{"name": "it's $(touch " + marker + ")"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "eth0; touch "+marker+":1\nit's $(touch "+marker+"):1\n", string(got))
+	assert.NoFileExists(t, marker)
+}
+
+func Test_shellQuote(t *testing.T) {
+	assert.Equal(t, `'eth0'`, shellQuote("eth0"))
+	assert.Equal(t, `''`, shellQuote(""))
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+}
+
+func Test_WatchService_pullSources_dependsOnFailure(t *testing.T) {
+	lister := &Source{
+		command: &testCommand{err: fmt.Errorf("command failed")},
+		parser:  &csvParser{},
+	}
+	lister.c.Id = "interfaces"
+
+	stats := &Source{
+		command: &testCommand{res: "eth0:1"},
+		parser:  &csvParser{},
+	}
+	stats.c.Id = "stats"
+	stats.c.DependsOn = SourceDependency{SourceId: "interfaces", RecordId: "list"}
+
+	ws := newWatchService()
+	ws.sources = []*Source{stats, lister}
+
+	data := ws.pullSources(context.Background(), nil)
+
+	_, ok := data.Load("stats")
+	assert.False(t, ok)
+}
+
+func Test_NewWatchService_defaultTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		defaultTimeout time.Duration
+		timeout        time.Duration
+		want           time.Duration
+	}{
+		{"builtin default", 0, 0, DefaultTimeout},
+		{"config default", 5 * time.Second, 0, 5 * time.Second},
+		{"source timeout", 5 * time.Second, 1 * time.Second, 1 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := NewWatchService(AppConfig{
+				DefaultTimeout: tt.defaultTimeout,
+				Sources: []SourceConfig{
+					{
+						Id:      "echo",
+						Command: "echo 1:ok",
+						Timeout: tt.timeout,
+						Output: SourceOutputConfig{
+							Parser:  "csv",
+							Records: []ParserRecordConfig{{Id: "r", Header: []string{"value", "status"}}},
+						},
+					},
+				},
+			})
+			s := ws.sources[0]
+			assert.Equal(t, tt.want, s.c.Timeout)
+
+			got, err := s.pull(context.Background(), nil)
+			assert.NoError(t, err)
+			assert.Equal(t, records{"r": []record{{"value": "1", "status": "ok"}}}, got)
+		})
+	}
+}
+
+func Test_WatchService_pullSources_jitter(t *testing.T) {
+	newSource := func(id string, jitter time.Duration) *Source {
+		s := &Source{
+			command: &testCommand{},
+			parser:  &testParser{},
+		}
+		s.c.Id = id
+		s.c.Jitter = jitter
+		return s
+	}
+
+	ws := newWatchService()
+	ws.rand = rand.New(rand.NewSource(1))
+	ws.sources = []*Source{
+		newSource("s1", 200*time.Millisecond),
+		newSource("s2", 200*time.Millisecond),
+		newSource("s3", 0),
+	}
+
+	start := time.Now()
+	ws.pullSources(context.Background(), nil)
+
+	executed := make([]time.Duration, len(ws.sources))
+	for i, s := range ws.sources {
+		c := s.command.(*testCommand)
+		assert.Len(t, c.executed, 1)
+		executed[i] = c.executed[0].Sub(start)
+	}
+
+	// rand.NewSource(1) yields delays of ~148ms and ~82ms for s1 and s2.
+	assert.True(t, executed[2] < 50*time.Millisecond, executed)
+	assert.True(t, executed[1] > 80*time.Millisecond, executed)
+	assert.True(t, executed[0]-executed[1] > 50*time.Millisecond, executed)
+}
+
+func Test_NewWatchService_buildInfo(t *testing.T) {
+	ws := NewWatchService(testConfig)
+
+	want := fmt.Sprintf(`
+# HELP watchmon_build_info Build version and loaded config hash, always 1.
+# TYPE watchmon_build_info gauge
+watchmon_build_info{config_hash="%s",version="dev"} 1
+`, testConfig.Hash())
+	err := testutil.GatherAndCompare(ws.Gatherer(), strings.NewReader(want), "watchmon_build_info")
+	assert.NoError(t, err)
+
+	assert.Len(t, testConfig.Hash(), 16)
+	assert.NotEqual(t, testConfig.Hash(), AppConfig{}.Hash())
+}
+
+func Test_NewWatchService_metricName(t *testing.T) {
+	config := AppConfig{
+		Monitors: []MonitorConfig{
+			{Id: "signal", MetricName: "watchmon_signal"},
+			{Id: "power"},
+		},
+	}
+	ws := NewWatchService(config)
+	ws.monitors[0].gauge.WithLabelValues().Set(1)
+	ws.monitors[1].gauge.WithLabelValues().Set(2)
+
+	for name, want := range map[string]int{"watchmon_signal": 1, "signal": 0, "power": 1} {
+		got, err := testutil.GatherAndCount(ws.Gatherer(), name)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, name)
+	}
+
+	graphs := makeConfigData(config)["graphs"].(dict)
+	assert.Equal(t, "#signal", graphs["signal"].(dict)["chartCanvas"])
+	assert.Equal(t, "watchmon_signal", graphs["signal"].(dict)["metricName"])
+	assert.Equal(t, "power", graphs["power"].(dict)["metricName"])
+}
+
+func Test_Source_pull_stages(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "status.txt")
+	err := os.WriteFile(output, []byte(`modem status
+--- interfaces ---
+eth0:1500
+wlan0:1400
+--- end ---
+<html><body><table><tbody>
+<tr><td>Channel</td><td>Power</td></tr>
+<tr><td>1</td><td>7.5</td></tr>
+<tr><td>2</td><td>6.8</td></tr>
+</tbody></table></body></html>
+`), 0644)
+	assert.NoError(t, err)
+
+	filename := filepath.Join(dir, "config.yaml")
+	err = os.WriteFile(filename, []byte(`
+monitors: []
+sources:
+  - id: modem
+    file: `+output+`
+    output:
+      stages:
+        - parser: csv
+          start: "--- interfaces ---"
+          end: "--- end ---"
+          records:
+            - id: interfaces
+              header: [name, mtu]
+        - parser: htmlquery
+          start: "--- end ---"
+          records:
+            - id: downstream
+              firstLineIsHeader: true
+              header: [channel, power]
+              parserOptions: {format: table, path: "//table[1]/tbody"}
+`), 0644)
+	assert.NoError(t, err)
+	config, err := LoadConfig(filename)
+	assert.NoError(t, err)
+	assert.NoError(t, config.Validate())
+
+	ws := NewWatchService(config)
+	got, err := ws.sources[0].pull(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, records{
+		"interfaces": []record{
+			{"name": "eth0", "mtu": "1500"},
+			{"name": "wlan0", "mtu": "1400"},
+		},
+		"downstream": []record{
+			{"channel": "1", "power": "7.5"},
+			{"channel": "2", "power": "6.8"},
+		},
+	}, got)
+	assert.Equal(t, "csv+htmlquery", ws.SourcesStatus()[0].Parser)
+
+	ws.sources[0].c.Output.Stages[0].Start = "--- missing ---"
+	_, err = ws.sources[0].pull(context.Background(), nil)
+	assert.EqualError(t, err, `stage 0: start marker "--- missing ---" not found`)
+}
+
+func Test_OutputStageConfig_part(t *testing.T) {
+	output := []byte("0123456789\nBEGIN\nabc\nEND\nxyz")
+	tests := []struct {
+		name  string
+		stage OutputStageConfig
+		want  string
+	}{
+		{"all", OutputStageConfig{}, string(output)},
+		{"range", OutputStageConfig{Offset: 2, Length: 5}, "23456"},
+		{"offset past the end", OutputStageConfig{Offset: 100}, ""},
+		{"markers", OutputStageConfig{Start: "BEGIN", End: "END"}, "abc\n"},
+		{"no end", OutputStageConfig{Start: "END"}, "xyz"},
+		{"range and markers", OutputStageConfig{Offset: 11, Length: 9, Start: "BEGIN", End: "END"}, "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.stage.part(output)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+}
+
+type panicParser struct{}
+
+func (p *panicParser) Parse(source *Source, reader io.Reader) (records, error) {
+	var rows [][]string
+	_ = rows[1] // out of range
+	return nil, nil
+}
+
+type panicMetric struct{}
+
+func (m *panicMetric) Write(monitor *Monitor, value metric) error {
+	panic("broken metric")
+}
+
+func (m *panicMetric) Delete(monitor *Monitor, labels []string) bool {
+	return false
+}
+
+func Test_WatchService_Start_panic(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	ws := newWatchService()
+	broken := &Source{command: &testCommand{}, parser: &panicParser{}}
+	broken.c.Id = "broken"
+	ok := &Source{command: &testCommand{}, parser: &testParser{res: records{"r": []record{{"v": "1"}}}}}
+	ok.c.Id = "ok"
+	ws.sources = []*Source{broken, ok}
+
+	written := &testMetric{}
+	good := &Monitor{c: MonitorConfig{Id: "good", Value: MonitorValueConfig{SourceId: "ok", RecordId: "r", Header: "v", Format: "%f"}}, metric: written}
+	bad := &Monitor{c: MonitorConfig{Id: "bad", Value: MonitorValueConfig{SourceId: "ok", RecordId: "r", Header: "v", Format: "%f"}}, metric: &panicMetric{}}
+	ws.monitors = []*Monitor{bad, good}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, ws.Start(ctx, 5*time.Millisecond))
+
+	status := ws.SourcesStatus()
+	assert.EqualError(t, status[0].LastError, "source: panic: runtime error: index out of range [1] with length 0")
+	assert.NoError(t, status[1].LastError)
+	assert.NotEmpty(t, written.written)
+	assert.Equal(t, 0.0, testutil.ToFloat64(ws.monitorUp.WithLabelValues("bad")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ws.monitorUp.WithLabelValues("good")))
+
+	var panics []string
+	for _, e := range hook.AllEntries() {
+		if e.Level == log.ErrorLevel {
+			panics = append(panics, e.Message)
+		}
+	}
+	assert.Contains(t, panics, "Pull panic: runtime error: index out of range [1] with length 0")
+	assert.Contains(t, panics, "Push panic: broken metric")
+}
+
+func Test_batchOrder(t *testing.T) {
+	var o batchOrder
+	older, newer := o.next(), o.next()
+
+	assert.True(t, o.apply(newer), "newer batch")
+	assert.False(t, o.apply(older), "older batch received after the newer one")
+	assert.False(t, o.apply(newer), "batch applied twice")
+
+	latest := o.next()
+	assert.True(t, o.apply(latest), "batch dispatched after the last applied")
+	assert.Equal(t, latest, o.applied)
+}
+
+func Test_WatchService_OnCycle(t *testing.T) {
+	ws := NewWatchService(AppConfig{
+		Sources: []SourceConfig{
+			{Id: "ok", Command: "echo 1", Output: SourceOutputConfig{
+				Parser:  "csv",
+				Records: []ParserRecordConfig{{Id: "r", Header: []string{"v"}}},
+			}},
+			{Id: "failing", Command: "exit 1", Output: SourceOutputConfig{Parser: "csv"}},
+		},
+	})
+	assert.NoError(t, ws.RunOnce(context.Background()))
+
+	var mu sync.Mutex
+	calls := map[string][]error{}
+	var got Records
+	ws.OnCycle(func(sourceId string, recs Records, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[sourceId] = append(calls[sourceId], err)
+		if sourceId == "ok" {
+			got = recs
+		}
+	})
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, ws.RunOnce(context.Background()))
+	}
+
+	assert.Equal(t, []error{nil, nil}, calls["ok"])
+	if assert.Len(t, calls["failing"], 2) {
+		assert.EqualError(t, calls["failing"][1], "exit status 1")
+	}
+	assert.Equal(t, Records{"r": []record{{"v": "1"}}}, got)
+}
@@ -2,14 +2,22 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/prometheus/common/expfmt"
 	watchmon "github.com/realitycheck/watchmon/app"
+	"github.com/realitycheck/watchmon/pkg/yamlutil"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/AlecAivazis/survey/v2"
@@ -17,9 +25,17 @@ import (
 )
 
 func main() {
-	app := &cli.App{
-		Name:  "watchmon",
-		Usage: "Streaming data into live charts.",
+	err := newApp().Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newApp() *cli.App {
+	return &cli.App{
+		Name:    "watchmon",
+		Usage:   "Streaming data into live charts.",
+		Version: watchmon.Version,
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
 				Name:  "debug",
@@ -36,26 +52,134 @@ func main() {
 				Usage:  "Create new configuration",
 				Action: create,
 			},
+			{
+				Name:  "validate",
+				Usage: "Validate specified configuration",
+				Flags: []cli.Flag{
+					&cli.PathFlag{
+						Name:     "configFile",
+						Usage:    "Load configuration from `FILE`, a directory of YAML files, - for stdin or an http(s) URL",
+						Aliases:  []string{"f"},
+						EnvVars:  []string{"WATCHMON_CONFIG"},
+						Required: true,
+					},
+				},
+				Action: validate,
+			},
+			{
+				Name:  "config",
+				Usage: "Inspect specified configuration",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "dump",
+						Usage: "Print the effective configuration, with files merged and defaults applied",
+						Flags: []cli.Flag{
+							&cli.PathFlag{
+								Name:     "configFile",
+								Usage:    "Load configuration from `FILE`, a directory of YAML files, - for stdin or an http(s) URL",
+								Aliases:  []string{"f"},
+								EnvVars:  []string{"WATCHMON_CONFIG"},
+								Required: true,
+							},
+							&cli.BoolFlag{
+								Name:  "json",
+								Usage: "Print as JSON instead of YAML",
+							},
+						},
+						Action: dumpConfig,
+					},
+				},
+			},
+			{
+				Name:  "doctor",
+				Usage: "Run each source of specified configuration once and diagnose its monitors",
+				Flags: []cli.Flag{
+					&cli.PathFlag{
+						Name:     "configFile",
+						Usage:    "Load configuration from `FILE`, a directory of YAML files, - for stdin or an http(s) URL",
+						Aliases:  []string{"f"},
+						EnvVars:  []string{"WATCHMON_CONFIG"},
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "noValidate",
+						Usage: "Skip configuration schema validation",
+					},
+				},
+				Action: doctor,
+			},
 			{
 				Name:  "run",
 				Usage: "Run specified configuration",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
-						Name:  "addr",
-						Value: "127.0.0.1:8081",
-						Usage: "Server address",
+						Name:    "addr",
+						Value:   "127.0.0.1:8081",
+						Usage:   "Server address",
+						EnvVars: []string{"WATCHMON_ADDR"},
+					},
+					&cli.StringFlag{
+						Name:  "metricsAddr",
+						Usage: "Serve the metrics on a separate address instead of the server address",
 					},
 					&cli.DurationFlag{
-						Name:  "refreshPeriod",
-						Value: 1 * time.Second,
-						Usage: "Refresh period",
+						Name:    "refreshPeriod",
+						Value:   watchmon.DefaultRefreshPeriod,
+						Usage:   "Refresh period, overrides the configuration refreshPeriod",
+						EnvVars: []string{"WATCHMON_REFRESH"},
 					},
 					&cli.PathFlag{
 						Name:     "configFile",
-						Usage:    "Load configuration from `FILE`",
+						Usage:    "Load configuration from `FILE`, a directory of YAML files, - for stdin or an http(s) URL",
 						Aliases:  []string{"f"},
+						EnvVars:  []string{"WATCHMON_CONFIG"},
 						Required: true,
 					},
+					&cli.BoolFlag{
+						Name:  "noValidate",
+						Usage: "Skip configuration schema validation",
+					},
+					&cli.DurationFlag{
+						Name:  "readTimeout",
+						Value: 10 * time.Second,
+						Usage: "Maximum duration for reading an entire request",
+					},
+					&cli.DurationFlag{
+						Name:  "writeTimeout",
+						Value: 30 * time.Second,
+						Usage: "Maximum duration before timing out writes of a response",
+					},
+					&cli.DurationFlag{
+						Name:  "idleTimeout",
+						Value: 120 * time.Second,
+						Usage: "Maximum duration to wait for the next request on keep-alive connections",
+					},
+					&cli.BoolFlag{
+						Name:  "once",
+						Usage: "Pull all sources once, push the metrics if configured and exit",
+					},
+					&cli.BoolFlag{
+						Name:  "dumpMetrics",
+						Usage: "Pull all sources once, print the metrics to stdout and exit",
+					},
+					&cli.BoolFlag{
+						Name:  "accessLog",
+						Usage: "Log every served request",
+					},
+					&cli.BoolFlag{
+						Name:  "waitFirstScrape",
+						Usage: "Report /healthz unavailable until the first pull cycle completes",
+					},
+					&cli.BoolFlag{
+						Name:    "pprof",
+						Usage:   "Serve the Go profiler at /debug/pprof/ on the server address",
+						EnvVars: []string{"WATCHMON_PPROF"},
+					},
+					&cli.StringFlag{
+						Name:    "adminToken",
+						Usage:   "Bearer `TOKEN` enabling the admin endpoints (POST /reload)",
+						EnvVars: []string{"WATCHMON_ADMIN_TOKEN"},
+					},
 				},
 				Action: run,
 			},
@@ -70,28 +194,230 @@ func main() {
 			return nil
 		},
 	}
+}
 
-	err := app.Run(os.Args)
-	if err != nil {
-		log.Fatal(err)
+func run(c *cli.Context) error {
+	if c.Bool("once") || c.Bool("dumpMetrics") {
+		return runOnce(c)
+	}
+
+	metricsAddr := c.String("metricsAddr")
+	app := watchmon.NewApplication(c.Path("configFile"), applicationOptions(c))
+	if err := app.Start(context.Background()); err != nil {
+		var problems watchmon.ConfigErrors
+		if errors.As(err, &problems) {
+			for _, p := range problems {
+				log.Errorf(" - %s", p)
+			}
+		}
+		log.Fatalf("Config error: %s", err)
 	}
+
+	if metricsAddr != "" {
+		metricsPath := app.Config().Resolved().MetricsPath
+		go func() {
+			fmt.Printf("Metrics at http://%s%s\n", metricsAddr, metricsPath)
+			handler := watchmon.NewCORSHandler(
+				watchmon.NewMetricsHandlerAt(app.Gatherer(), metricsPath),
+				dashboardOrigin(c.String("addr")),
+			)
+			log.Fatal(newServer(c, metricsAddr, handler).ListenAndServe())
+		}()
+	}
+
+	fmt.Printf("Run at http://%s\n", c.String("addr"))
+	return newServer(c, c.String("addr"), profilingHandler(c, app)).ListenAndServe()
 }
 
-func run(c *cli.Context) error {
-	config, err := watchmon.LoadConfig(c.Path("configFile"))
+// dashboardOrigin returns whether an origin is the dashboard served at
+// addr, letting it poll the metrics served apart. An addr without host
+// accepts the dashboard port on any host.
+func dashboardOrigin(addr string) func(origin string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = ""
+	}
+	return func(origin string) bool {
+		u, uerr := url.Parse(origin)
+		if err != nil || uerr != nil || u.Port() != port {
+			return false
+		}
+		return host == "" || u.Hostname() == strings.Trim(host, "[]")
+	}
+}
+
+// profilingHandler adds the pprof endpoints to handler when enabled by
+// the run flags.
+func profilingHandler(c *cli.Context, handler http.Handler) http.Handler {
+	if !c.Bool("pprof") {
+		return handler
+	}
+	return watchmon.NewProfilingHandler(handler)
+}
+
+// runOnce runs a single watch cycle of the config, pushing the metrics to
+// the Pushgateway and the textfile if configured. With dumpMetrics, the
+// gathered metrics are written in the text exposition format, otherwise
+// nothing is, for cron not to mail it.
+func runOnce(c *cli.Context) error {
+	opts := applicationOptions(c)
+	config, err := watchmon.LoadConfigWithOptions(c.Path("configFile"), opts.LoadConfigOptions)
+	if err == nil {
+		err = config.Validate()
+	}
 	if err != nil {
-		log.Fatalf("Config error: %s", err)
+		return err
 	}
 
 	ws := watchmon.NewWatchService(config)
-	hs := watchmon.NewHTTPService(config)
+	if err := ws.RunOnce(context.Background()); err != nil {
+		return err
+	}
+	if !c.Bool("dumpMetrics") {
+		return nil
+	}
+	families, err := ws.Gatherer().Gather()
+	if err != nil {
+		return err
+	}
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(c.App.Writer, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	go ws.Start(context.Background(), c.Duration("refreshPeriod"))
-	fmt.Printf("Run at http://%s\n", c.String("addr"))
-	http.ListenAndServe(c.String("addr"), hs)
+// applicationOptions returns the application options set by the run flags.
+// The refresh period is only set when given, so the config one applies
+// otherwise.
+func applicationOptions(c *cli.Context) watchmon.ApplicationOptions {
+	opts := watchmon.ApplicationOptions{
+		LoadConfigOptions: watchmon.LoadConfigOptions{
+			NoValidate: c.Bool("noValidate"),
+		},
+		AdminToken:      c.String("adminToken"),
+		WaitFirstScrape: c.Bool("waitFirstScrape"),
+		SeparateMetrics: c.String("metricsAddr") != "",
+		MetricsAddr:     c.String("metricsAddr"),
+	}
+	if c.IsSet("refreshPeriod") {
+		opts.RefreshPeriod = c.Duration("refreshPeriod")
+	}
+	return opts
+}
+
+// newServer makes an HTTP server with the timeouts and the access log set
+// by the run flags.
+func newServer(c *cli.Context, addr string, handler http.Handler) *http.Server {
+	if c.Bool("accessLog") {
+		handler = watchmon.NewLoggingHandler(handler)
+	}
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  c.Duration("readTimeout"),
+		WriteTimeout: c.Duration("writeTimeout"),
+		IdleTimeout:  c.Duration("idleTimeout"),
+	}
+}
+
+func validate(c *cli.Context) error {
+	_, err := checkConfig(c)
+	return err
+}
+
+// checkConfig loads the config with the run options and validates it,
+// printing its problems or that it is ok.
+func checkConfig(c *cli.Context) (watchmon.AppConfig, error) {
+	filename := c.Path("configFile")
+	config, err := watchmon.LoadConfigWithOptions(filename, applicationOptions(c).LoadConfigOptions)
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		var problems watchmon.ConfigErrors
+		if !errors.As(err, &problems) {
+			problems = watchmon.ConfigErrors{err}
+		}
+		for _, p := range problems {
+			fmt.Fprintf(c.App.Writer, " - %s\n", p)
+		}
+		return config, fmt.Errorf("%s: %d problem(s) found", filename, len(problems))
+	}
+	fmt.Fprintf(c.App.Writer, "%s: ok\n", filename)
+	return config, nil
+}
+
+// doctor validates the config, pulls every source once and prints what
+// each source and monitor read, with hints on the likely cause of each
+// problem.
+func doctor(c *cli.Context) error {
+	config, err := checkConfig(c)
+	if err != nil {
+		return err
+	}
+	filename := c.Path("configFile")
+
+	w := c.App.Writer
+	report := watchmon.NewWatchService(config).Diagnose(c.Context)
+	for _, s := range report.Sources {
+		if s.Err != nil {
+			fmt.Fprintf(w, "source %s: error: %s\n", s.Id, s.Err)
+			continue
+		}
+		ids := make([]string, 0, len(s.Rows))
+		for id := range s.Rows {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		counts := make([]string, len(ids))
+		for i, id := range ids {
+			counts[i] = fmt.Sprintf("%s=%d", id, s.Rows[id])
+		}
+		fmt.Fprintf(w, "source %s: ok, rows: %s\n", s.Id, strings.Join(counts, " "))
+	}
+	for _, m := range report.Monitors {
+		status := "ok"
+		if len(m.Hints) > 0 {
+			status = "problem"
+		}
+		fmt.Fprintf(w, "monitor %s: %s, rows: %d, values: %d, non-zero: %d\n", m.Id, status, m.Rows, m.Values, m.NonZero)
+		for _, h := range m.Hints {
+			fmt.Fprintf(w, "  hint: %s\n", h)
+		}
+	}
+	if n := report.Problems(); n > 0 {
+		return fmt.Errorf("%s: %d problem(s) found", filename, n)
+	}
 	return nil
 }
 
+// dumpConfig prints the config in effect, with its files merged and the
+// defaults applied, as YAML or JSON.
+func dumpConfig(c *cli.Context) error {
+	config, err := watchmon.LoadConfig(c.Path("configFile"))
+	if err != nil {
+		return err
+	}
+	data, err := yamlutil.Marshal(config.Resolved())
+	if err != nil {
+		return err
+	}
+	if c.Bool("json") {
+		var v interface{}
+		if err := yamlutil.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		if data, err = json.MarshalIndent(v, "", "  "); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	}
+	_, err = c.App.Writer.Write(data)
+	return err
+}
+
 func create(c *cli.Context) error {
 	answers := struct {
 		Filename string
@@ -123,42 +449,37 @@ func create(c *cli.Context) error {
 		return err
 	}
 
-	return watchmon.AppConfig{
-		Monitors: []watchmon.MonitorConfig{
-			{
-				Id:    "my_monitor",
-				Title: "My monitor",
-				Value: watchmon.MonitorValueConfig{
-					SourceId: "my_source",
-					RecordId: "my_record",
-					Header:   "value",
-					Labels: []watchmon.MonitorValueLabelConfig{
-						{Header: "id"},
-					},
-				},
-			},
-		},
-		Sources: []watchmon.SourceConfig{
-			{
-				Id:      "my_source",
-				Command: "echo 123",
-				Timeout: 1 * time.Second,
-				Output: watchmon.SourceOutputConfig{
-					Parser: answers.Parser,
-					Records: []watchmon.ParserRecordConfig{
-						{
-							Id:                "my_record",
-							FirstLineIsHeader: false,
-							Header:            []string{"id", "value"},
-						},
-					},
-				},
-			},
-		},
-		Graphs: []watchmon.GraphConfig{
-			{
-				Id: "my_monitor",
-			},
-		},
-	}.Save(answers.Filename)
+	data, err := watchmon.ExampleConfig(answers.Parser)
+	if err != nil {
+		return err
+	}
+	return writeConfig(answers.Filename, data, func(filename string) (bool, error) {
+		overwrite := false
+		err := survey.AskOne(&survey.Confirm{
+			Message: fmt.Sprintf("%s exists, overwrite?", filename),
+		}, &overwrite)
+		return overwrite, err
+	})
+}
+
+// writeConfig validates the config data and writes it to filename, creating
+// its directory if needed. An existing file is only overwritten when
+// confirmed by overwrite.
+func writeConfig(filename string, data []byte, overwrite func(filename string) (bool, error)) error {
+	if err := watchmon.ValidateConfigData(filename, data); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	if _, err := os.Stat(filename); err == nil {
+		ok, err := overwrite(filename)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s: file exists", filename)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
 }
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	watchmon "github.com/realitycheck/watchmon/app"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+func Test_validate(t *testing.T) {
+	dir := t.TempDir()
+
+	broken := filepath.Join(dir, "broken.yaml")
+	err := os.WriteFile(broken, []byte(`
+monitors:
+  - id: signal_strength
+    value:
+      sourceId: network
+      recordId: wlan
+sources:
+  - id: network
+    command: echo
+    output:
+      parser: csv
+      records:
+        - id: wifi
+graphs:
+  - id: signal_strength
+  - id: signal_strength
+`), 0644)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		configFile string
+		wantOutput string
+		wantErr    string
+	}{
+		{
+			"ok",
+			"example_config.yaml",
+			"example_config.yaml: ok\n",
+			"",
+		},
+		{
+			"broken",
+			broken,
+			" - monitors.0.value.recordId: unknown record id \"wlan\" in source \"network\"\n" +
+				" - graphs.1.id: duplicate graph id \"signal_strength\"\n",
+			broken + ": 2 problem(s) found",
+		},
+		{
+			"missing",
+			filepath.Join(dir, "missing.yaml"),
+			" - open " + filepath.Join(dir, "missing.yaml") + ": no such file or directory\n",
+			filepath.Join(dir, "missing.yaml") + ": 1 problem(s) found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			app := newApp()
+			app.Writer = out
+
+			err := app.Run([]string{"watchmon", "validate", "-f", tt.configFile})
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantOutput, out.String())
+		})
+	}
+}
+
+func Test_newServer(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want [3]time.Duration
+	}{
+		{
+			"defaults",
+			nil,
+			[3]time.Duration{10 * time.Second, 30 * time.Second, 120 * time.Second},
+		},
+		{
+			"flags",
+			[]string{"--readTimeout", "1s", "--writeTimeout", "2s", "--idleTimeout", "3s"},
+			[3]time.Duration{1 * time.Second, 2 * time.Second, 3 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var srv *http.Server
+			app := newApp()
+			for _, cmd := range app.Commands {
+				if cmd.Name == "run" {
+					cmd.Action = func(c *cli.Context) error {
+						srv = newServer(c, "127.0.0.1:0", http.NotFoundHandler())
+						return nil
+					}
+				}
+			}
+
+			args := append([]string{"watchmon", "run", "-f", "example_config.yaml"}, tt.args...)
+			assert.NoError(t, app.Run(args))
+			assert.Equal(t, "127.0.0.1:0", srv.Addr)
+			assert.Equal(t, tt.want, [3]time.Duration{srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout})
+		})
+	}
+}
+
+func Test_profilingHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"disabled", nil, http.StatusNotFound},
+		{"enabled", []string{"--pprof"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handler http.Handler
+			app := newApp()
+			for _, cmd := range app.Commands {
+				if cmd.Name == "run" {
+					cmd.Action = func(c *cli.Context) error {
+						handler = profilingHandler(c, http.NotFoundHandler())
+						return nil
+					}
+				}
+			}
+
+			args := append([]string{"watchmon", "run", "-f", "example_config.yaml"}, tt.args...)
+			assert.NoError(t, app.Run(args))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+			assert.Equal(t, tt.want, w.Code)
+
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			assert.Equal(t, http.StatusNotFound, w.Code)
+		})
+	}
+}
+
+func Test_writeConfig(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.yaml")
+	assert.NoError(t, os.WriteFile(existing, []byte("old"), 0644))
+
+	valid := []byte("monitors: []\nsources: []\n")
+
+	tests := []struct {
+		name      string
+		filename  string
+		data      []byte
+		overwrite bool
+		want      string
+		wantErr   string
+	}{
+		{
+			name:     "new file",
+			filename: filepath.Join(dir, "new.yaml"),
+			data:     valid,
+			want:     string(valid),
+		},
+		{
+			name:     "new directory",
+			filename: filepath.Join(dir, "etc", "watchmon", "config.yaml"),
+			data:     valid,
+			want:     string(valid),
+		},
+		{
+			name:     "invalid config",
+			filename: filepath.Join(dir, "invalid.yaml"),
+			data:     []byte("monitors: []\n"),
+			wantErr:  "invalid config: " + filepath.Join(dir, "invalid.yaml") + ": sources: required",
+		},
+		{
+			name:     "existing file kept",
+			filename: existing,
+			data:     valid,
+			want:     "old",
+			wantErr:  existing + ": file exists",
+		},
+		{
+			name:      "existing file overwritten",
+			filename:  existing,
+			data:      valid,
+			overwrite: true,
+			want:      string(valid),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := writeConfig(tt.filename, tt.data, func(string) (bool, error) {
+				return tt.overwrite, nil
+			})
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			got, _ := os.ReadFile(tt.filename)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+}
+
+func Test_applicationOptions_refreshPeriod(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want time.Duration
+	}{
+		{"unset", nil, 0},
+		{"flag", []string{"--refreshPeriod", "3s"}, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got time.Duration
+			app := newApp()
+			for _, cmd := range app.Commands {
+				if cmd.Name == "run" {
+					cmd.Action = func(c *cli.Context) error {
+						got = applicationOptions(c).RefreshPeriod
+						return nil
+					}
+				}
+			}
+
+			args := append([]string{"watchmon", "run", "-f", "example_config.yaml"}, tt.args...)
+			assert.NoError(t, app.Run(args))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_run_env(t *testing.T) {
+	type flags struct {
+		addr          string
+		refreshPeriod time.Duration
+		configFile    string
+	}
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want flags
+	}{
+		{
+			"defaults",
+			nil,
+			[]string{"-f", "example_config.yaml"},
+			flags{"127.0.0.1:8081", 0, "example_config.yaml"},
+		},
+		{
+			"env",
+			map[string]string{
+				"WATCHMON_ADDR":    "0.0.0.0:9090",
+				"WATCHMON_REFRESH": "5s",
+				"WATCHMON_CONFIG":  "env.yaml",
+			},
+			nil,
+			flags{"0.0.0.0:9090", 5 * time.Second, "env.yaml"},
+		},
+		{
+			"flags over env",
+			map[string]string{
+				"WATCHMON_ADDR":    "0.0.0.0:9090",
+				"WATCHMON_REFRESH": "5s",
+				"WATCHMON_CONFIG":  "env.yaml",
+			},
+			[]string{"--addr", ":8082", "--refreshPeriod", "2s", "-f", "flag.yaml"},
+			flags{":8082", 2 * time.Second, "flag.yaml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var got flags
+			app := newApp()
+			for _, cmd := range app.Commands {
+				if cmd.Name == "run" {
+					cmd.Action = func(c *cli.Context) error {
+						got = flags{c.String("addr"), applicationOptions(c).RefreshPeriod, c.Path("configFile")}
+						return nil
+					}
+				}
+			}
+
+			assert.NoError(t, app.Run(append([]string{"watchmon", "run"}, tt.args...)))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_dashboardOrigin(t *testing.T) {
+	tests := []struct {
+		addr   string
+		origin string
+		want   bool
+	}{
+		{"127.0.0.1:8081", "http://127.0.0.1:8081", true},
+		{"127.0.0.1:8081", "http://localhost:8081", false},
+		{"127.0.0.1:8081", "http://127.0.0.1:8082", false},
+		{":8081", "http://monitor.lan:8081", true},
+		{"0.0.0.0:8081", "http://monitor.lan:8081", true},
+		{":8081", "https://evil.example", false},
+		{"8081", "http://monitor.lan:8081", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, dashboardOrigin(tt.addr)(tt.origin), "%s %s", tt.addr, tt.origin)
+	}
+}
+
+func Test_run_once(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	textfile := filepath.Join(dir, "watchmon.prom")
+	err := os.WriteFile(configFile, []byte(`
+textfile:
+  path: `+textfile+`
+monitors:
+  - id: signal
+    value: {sourceId: network, recordId: wifi, header: signal, labels: [{header: ssid}]}
+sources:
+  - id: network
+    command: echo 42:home
+    output:
+      parser: csv
+      records:
+        - id: wifi
+          header: [signal, ssid]
+`), 0644)
+	assert.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	app := newApp()
+	app.Writer = out
+
+	err = app.Run([]string{"watchmon", "run", "--once", "-f", configFile})
+	assert.NoError(t, err)
+	assert.Empty(t, out.String(), "--once prints nothing")
+	data, err := os.ReadFile(textfile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "signal{ssid=\"home\"} 42\n")
+
+	out.Reset()
+	app = newApp()
+	app.Writer = out
+	err = app.Run([]string{"watchmon", "run", "--dumpMetrics", "-f", configFile})
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "signal{ssid=\"home\"} 42\n")
+}
+
+func Test_dumpConfig(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"1-monitors.yaml": `
+monitors:
+  - id: signal
+    value: {sourceId: network, recordId: wifi, header: signal}
+graphs:
+  - id: signal
+`,
+		"2-sources.yaml": `
+defaultTimeout: 5s
+sources:
+  - id: network
+    command: echo 42
+    output:
+      parser: csv
+      records:
+        - id: wifi
+          header: [signal]
+`,
+	} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+
+	want := watchmon.AppConfig{
+		DefaultTimeout: 5 * time.Second,
+		RefreshPeriod:  watchmon.DefaultRefreshPeriod,
+		Monitors: []watchmon.MonitorConfig{
+			{
+				Id:   "signal",
+				Type: "gauge",
+				Value: watchmon.MonitorValueConfig{
+					SourceId: "network",
+					RecordId: "wifi",
+					Header:   "signal",
+					Format:   "%f",
+					Labels:   []watchmon.MonitorValueLabelConfig{},
+				},
+			},
+		},
+		Sources: []watchmon.SourceConfig{
+			{
+				Id:      "network",
+				Type:    "shell",
+				Command: "echo 42",
+				Timeout: 5 * time.Second,
+				Output: watchmon.SourceOutputConfig{
+					Parser: "csv",
+					Records: []watchmon.ParserRecordConfig{
+						{Id: "wifi", Header: []string{"signal"}, ParserOptions: map[string]string{}},
+					},
+				},
+			},
+		},
+		UI:          watchmon.UIConfig{Title: watchmon.DefaultUITitle},
+		MetricsPath: watchmon.DefaultMetricsPath,
+	}
+
+	out := &bytes.Buffer{}
+	app := newApp()
+	app.Writer = out
+	assert.NoError(t, app.Run([]string{"watchmon", "config", "dump", "-f", dir}))
+
+	var got watchmon.AppConfig
+	assert.NoError(t, yaml.Unmarshal(out.Bytes(), &got))
+	if assert.Len(t, got.Graphs, 1) {
+		assert.Equal(t, "signal", got.Graphs[0].Id)
+		assert.Equal(t, watchmon.DefaultChartDelay, got.Graphs[0].ChartDelay)
+	}
+	got.Graphs = nil
+	assert.Equal(t, want, got)
+
+	out.Reset()
+	assert.NoError(t, app.Run([]string{"watchmon", "config", "dump", "-f", dir, "--json"}))
+	var dump map[string]interface{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &dump))
+	assert.Equal(t, "5s", dump["defaultTimeout"])
+	assert.Equal(t, "1s", dump["refreshPeriod"])
+	assert.Equal(t, "shell", dump["sources"].([]interface{})[0].(map[string]interface{})["type"])
+}
+
+func Test_doctor(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte(`
+monitors:
+  - id: signal
+    value: {sourceId: network, recordId: wifi, header: signal}
+  - id: power
+    value: {sourceId: network, recordId: downstream, header: power}
+sources:
+  - id: network
+    command: echo 42:-3
+    output:
+      parser: csv
+      records:
+        - id: wifi
+          header: [signal]
+        - id: downstream
+          header: [snr, level]
+`), 0644)
+	assert.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	app := newApp()
+	app.Writer = out
+
+	err = app.Run([]string{"watchmon", "doctor", "-f", configFile})
+	assert.EqualError(t, err, configFile+": 1 problem(s) found")
+	assert.Equal(t, configFile+": ok\n"+
+		"source network: ok, rows: downstream=1 wifi=1\n"+
+		"monitor signal: ok, rows: 1, values: 1, non-zero: 1\n"+
+		"monitor power: problem, rows: 1, values: 0, non-zero: 0\n"+
+		"  hint: header \"power\" not found in record \"downstream\" (headers: \"level\", \"snr\")\n",
+		out.String())
+}
+
+func Test_doctor_noValidate(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte(`
+futureField: true
+monitors:
+  - id: signal
+    value: {sourceId: network, recordId: wifi, header: signal}
+sources:
+  - id: network
+    command: echo 42
+    output:
+      parser: csv
+      records:
+        - id: wifi
+          header: [signal]
+`), 0644)
+	assert.NoError(t, err)
+
+	app := newApp()
+	app.Writer = &bytes.Buffer{}
+	assert.Error(t, app.Run([]string{"watchmon", "doctor", "-f", configFile}))
+
+	out := &bytes.Buffer{}
+	app = newApp()
+	app.Writer = out
+	assert.NoError(t, app.Run([]string{"watchmon", "doctor", "--noValidate", "-f", configFile}))
+	assert.Equal(t, configFile+": ok\n"+
+		"source network: ok, rows: wifi=1\n"+
+		"monitor signal: ok, rows: 1, values: 1, non-zero: 1\n",
+		out.String())
+}